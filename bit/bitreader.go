@@ -0,0 +1,104 @@
+package bitwriter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Reader reads from an io.Reader, MSB-first. It buffers up to 64 bits at a
+// time, so peeking at the next few bits is cheap.
+type Reader struct {
+	r      io.ByteReader
+	bits   uint64 // The low n bits are buffered, and haven't been read
+	n      uint
+	offset int64
+	err    error
+}
+
+// NewReader creates a new bitreader. r is buffered if it isn't already an
+// io.ByteReader.
+func NewReader(r io.Reader) *Reader {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Reader{r: br}
+}
+
+// NewReaderAt creates a new bitreader that starts reading r at the given bit
+// offset, which doesn't need to be a multiple of 8. Offset counts from the
+// start of r, rather than from where reading started.
+func NewReaderAt(r io.ReaderAt, offset int64) *Reader {
+	br := NewReader(io.NewSectionReader(r, offset/8, math.MaxInt64-offset/8))
+	br.offset = offset &^ 7
+	br.Skip(uint(offset & 7))
+	return br
+}
+
+// refill buffers as many whole bytes as will fit
+func (r *Reader) refill() {
+	for r.n <= 56 && r.err == nil {
+		var b byte
+		b, r.err = r.r.ReadByte()
+		if r.err != nil {
+			return
+		}
+		r.bits = r.bits<<8 | uint64(b)
+		r.n += 8
+	}
+}
+
+// ReadBit reads a single bit
+func (r *Reader) ReadBit() (b byte, err error) {
+	v, err := r.ReadBits32(1)
+	return byte(v), err
+}
+
+// ReadBits32 reads up to 32 bits at once
+func (r *Reader) ReadBits32(count uint) (v uint32, err error) {
+	v, err = r.PeekBits(count)
+	if err != nil {
+		return 0, err
+	}
+	r.n -= count
+	r.offset += int64(count)
+	return v, nil
+}
+
+// PeekBits returns the next count bits (up to 32) without reading them. If
+// fewer than count bits are left, the missing ones are zero, and the error
+// that stopped them from being read is returned alongside.
+func (r *Reader) PeekBits(count uint) (v uint32, err error) {
+	if count > 32 {
+		return 0, fmt.Errorf("You can't stuff %d bits in an int32", count)
+	}
+	if r.n < count {
+		r.refill()
+	}
+	if r.n < count {
+		return uint32(r.bits<<(count-r.n)) & (1<<count - 1), r.err
+	}
+	return uint32(r.bits>>(r.n-count)) & (1<<count - 1), nil
+}
+
+// Skip reads and throws away up to 32 bits
+func (r *Reader) Skip(count uint) error {
+	_, err := r.ReadBits32(count)
+	return err
+}
+
+// Align skips ahead to the next byte boundary, and returns the number of bits
+// that were skipped
+func (r *Reader) Align() (n uint) {
+	n = uint(-r.offset & 7)
+	r.n -= n
+	r.offset += int64(n)
+	return n
+}
+
+// Offset returns the bit offset of the next bit to be read
+func (r *Reader) Offset() int64 {
+	return r.offset
+}
@@ -0,0 +1,80 @@
+package bitwriter
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestReader(t *testing.T) {
+	input := []byte{0xa5, 0x0f, 0xff, 0x00, 0x81}
+	r := NewReader(bytes.NewReader(input))
+
+	if b, err := r.ReadBit(); b != 1 || err != nil {
+		t.Errorf("ReadBit: expected 1, got %d, %v", b, err)
+	}
+	if v, err := r.PeekBits(7); v != 0x25 || err != nil {
+		t.Errorf("PeekBits(7): expected %07b, got %07b, %v", 0x25, v, err)
+	}
+	if v, err := r.ReadBits32(11); v != 0x250 || err != nil {
+		t.Errorf("ReadBits32(11): expected %011b, got %011b, %v", 0x250, v, err)
+	}
+	if n := r.Align(); n != 4 {
+		t.Errorf("Align: expected to skip 4 bits, skipped %d", n)
+	}
+	if n := r.Align(); n != 0 {
+		t.Errorf("Align: expected to skip 0 bits, skipped %d", n)
+	}
+	if offset := r.Offset(); offset != 16 {
+		t.Errorf("Offset: expected 16, got %d", offset)
+	}
+	if v, err := r.ReadBits32(20); v != 0xff008 || err != nil {
+		t.Errorf("ReadBits32(20): expected %x, got %x, %v", 0xff008, v, err)
+	}
+
+	// Peeking past the end pads with zeroes
+	if v, err := r.PeekBits(8); v != 0x10 || err != io.EOF {
+		t.Errorf("PeekBits(8): expected %08b and EOF, got %08b, %v", 0x10, v, err)
+	}
+	if _, err := r.ReadBits32(8); err != io.EOF {
+		t.Errorf("ReadBits32(8): expected EOF, got %v", err)
+	}
+	if v, err := r.ReadBits32(4); v != 1 || err != nil {
+		t.Errorf("ReadBits32(4): expected 1, got %d, %v", v, err)
+	}
+	if _, err := r.ReadBit(); err != io.EOF {
+		t.Errorf("ReadBit: expected EOF, got %v", err)
+	}
+}
+
+func TestReaderAt(t *testing.T) {
+	input := []byte{0xa5, 0x0f, 0xff, 0x00, 0x81}
+	for offset := int64(0); offset < 40; offset++ {
+		r := NewReaderAt(bytes.NewReader(input), offset)
+		for i := offset; i < 40; i++ {
+			if r.Offset() != i {
+				t.Fatalf("NewReaderAt(%d): Offset() is %d, expected %d", offset, r.Offset(), i)
+			}
+			expected := input[i/8] >> uint(7-i%8) & 1
+			if b, err := r.ReadBit(); b != expected || err != nil {
+				t.Fatalf("NewReaderAt(%d): bit %d is %d, %v, expected %d", offset, i, b, err, expected)
+			}
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for i := uint(0); i <= 32; i++ {
+		w.WriteBits32(1<<i-1, i)
+	}
+	w.Close()
+
+	r := NewReader(&buf)
+	for i := uint(0); i <= 32; i++ {
+		if v, err := r.ReadBits32(i); v != 1<<i-1 || err != nil {
+			t.Errorf("ReadBits32(%d): expected %b, got %b, %v", i, uint32(1<<i-1), v, err)
+		}
+	}
+}
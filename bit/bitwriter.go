@@ -6,91 +6,121 @@ import (
 	"io"
 )
 
+// Number of complete bytes to hold onto before writing them out
 const capacity = 1024
 
+var errClosed = errors.New("Can't write to a closed file")
+
 //type Writer interface {
 //WriteBit(b byte) (err error)
 //WriteBits(b byte, count int) (n int, err error)
 //Close() (err error)
 //}
 
-// Writer writes to an io.Writer, one bit at a time.
+// Writer writes to an io.Writer, MSB-first. Bits are gathered into a 64-bit
+// accumulator, and only complete bytes are passed on.
+//
+// Once writing to the io.Writer fails, every later call returns the same error.
 type Writer struct {
-	w             io.Writer
-	cache         []byte
-	bitsUnflushed uint
-	closed        bool
+	w      io.Writer
+	bits   uint64 // The low n bits haven't made up a full byte yet
+	n      uint
+	cache  []byte // Complete bytes that haven't been written out
+	offset int64
+	err    error
+	closed bool
 }
 
 // NewWriter creates a new bitwriter
 func NewWriter(w io.Writer) *Writer {
 
-	return &Writer{w: w, cache: make([]byte, capacity)}
+	return &Writer{w: w, cache: make([]byte, 0, capacity)}
+}
+
+// Reset discards any bits that haven't been written, clears any error, and
+// makes w write to dst. The cache is kept.
+func (w *Writer) Reset(dst io.Writer) {
+	*w = Writer{w: dst, cache: w.cache[:0]}
 }
 
 // WriteBit writes a single bit
 func (w *Writer) WriteBit(b byte) (err error) {
-	if w.closed {
-		return errors.New("Can't write to a closed file")
-	}
-	if w.bitsUnflushed == capacity {
-		err := w.flush()
-		if err != nil {
-			return err
-		}
-	}
-	idx := w.bitsUnflushed >> 3         // Divide by 8 to get byte index
-	bitPos := w.bitsUnflushed & 7       // Only retain lower three bits
-	w.cache[idx] |= (b << (7 - bitPos)) // TODO: Is this right? Little-endian vs big-endian
-	w.bitsUnflushed++
-
-	return nil
+	_, err = w.WriteBits32(uint32(b&1), 1)
+	return err
 }
 
-// WriteBits32 writes up to 32 bits at once
+// WriteBits32 writes the low count bits of b, up to 32 at once, and returns
+// the number of bits written
 func (w *Writer) WriteBits32(b uint32, count uint) (n int, err error) {
 	if count > 32 {
 		return 0, fmt.Errorf("You can't stuff %d bits in an int32", count)
 	}
-	//TODO: Faster implementation
-	//TODO: Should this be reversed?
-	for ; count > 0; count-- {
-		w.WriteBit(byte((b >> (count - 1)) & 1))
+	if w.err != nil {
+		return 0, w.err
 	}
-	return 0, nil
-}
-
-// This is probably overly-complex since flush() is only called when the cache is full
-func (w *Writer) flush() (err error) {
-	if w.bitsUnflushed == 0 {
-		return nil
+	if w.closed {
+		return 0, errClosed
 	}
 
-	w.bitsUnflushed = w.bitsUnflushed & 7
-	var tmp byte
-	if w.bitsUnflushed != 0 { // If not an even number of bytes...?
-		tmp = w.cache[len(w.cache)-1] // pop off the last bit
-		w.cache = w.cache[:len(w.cache)-1]
+	w.bits = w.bits<<count | uint64(b)&(1<<count-1)
+	w.n += count
+	w.offset += int64(count)
+	for w.n >= 8 {
+		w.n -= 8
+		w.cache = append(w.cache, byte(w.bits>>w.n))
 	}
 
-	n, err := w.w.Write(w.cache[:])
+	if len(w.cache) >= capacity {
+		if err := w.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	return int(count), nil
+}
 
-	w.cache = w.cache[:0]
-	if w.bitsUnflushed != 0 {
-		w.cache[0] = tmp
+// Align pads the output with zeroes up to the next byte boundary, and returns
+// the number of bits of padding that were written
+func (w *Writer) Align() (n uint, err error) {
+	n = -w.n & 7
+	if _, err = w.WriteBits32(0, n); err != nil {
+		return 0, err
 	}
+	return n, nil
+}
 
-	if n < len(w.cache) || err != nil {
-		return err
+// Flush writes out all complete bytes. Bits past the last byte boundary are
+// held onto; call Align first to write those too.
+func (w *Writer) Flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	if len(w.cache) == 0 {
+		return nil
 	}
 
-	return nil
+	n, err := w.w.Write(w.cache)
+	if err == nil && n < len(w.cache) {
+		err = io.ErrShortWrite
+	}
+	w.cache = w.cache[:0]
+	w.err = err
+	return err
 }
 
 // Close adds padding and prevents any more bits from being written
 func (w *Writer) Close() (err error) {
-	_, err = w.w.Write(w.cache)
+	if w.closed {
+		return w.err
+	}
+	if _, err = w.Align(); err == nil {
+		err = w.Flush()
+	}
 	w.closed = true
-	fmt.Println("Wrote")
 	return err
 }
+
+// Offset returns the number of bits written so far, including any that haven't
+// been flushed
+func (w *Writer) Offset() int64 {
+	return w.offset
+}
@@ -0,0 +1,95 @@
+package bitwriter
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.WriteBit(1)
+	w.WriteBits32(0x25, 7)
+	w.WriteBits32(0x0f, 8)
+	if n, err := w.Align(); n != 0 || err != nil {
+		t.Errorf("Align: expected no padding, got %d bits, %v", n, err)
+	}
+	w.WriteBits32(0x3, 3)
+	if n, err := w.Align(); n != 5 || err != nil {
+		t.Errorf("Align: expected 5 bits of padding, got %d, %v", n, err)
+	}
+	w.WriteBits32(0xffffffff, 32)
+	w.WriteBits32(0x5, 3)
+	if offset := w.Offset(); offset != 59 {
+		t.Errorf("Offset: expected 59 bits, got %d", offset)
+	}
+
+	// Nothing gets written until a flush
+	if buf.Len() != 0 {
+		t.Errorf("Expected nothing written before Flush, got %x", buf.Bytes())
+	}
+	if err := w.Flush(); err != nil {
+		t.Errorf("Flush: %v", err)
+	}
+	expected := []byte{0xa5, 0x0f, 0x60, 0xff, 0xff, 0xff, 0xff}
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Errorf("Flush: expected %x, got %x", expected, buf.Bytes())
+	}
+
+	// Close pads out the last partial byte
+	if err := w.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	expected = append(expected, 0xa0)
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Errorf("Close: expected %x, got %x", expected, buf.Bytes())
+	}
+	if err := w.WriteBit(1); err == nil {
+		t.Errorf("WriteBit: expected an error after Close")
+	}
+}
+
+func TestWriterLarge(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for i := 0; i < 10*capacity; i++ {
+		w.WriteBits32(uint32(i), 13)
+	}
+	w.Close()
+
+	r := NewReader(&buf)
+	for i := 0; i < 10*capacity; i++ {
+		if v, err := r.ReadBits32(13); v != uint32(i)&(1<<13-1) || err != nil {
+			t.Fatalf("ReadBits32: value %d read back as %d, %v", i, v, err)
+		}
+	}
+}
+
+type failingWriter struct{ err error }
+
+func (f failingWriter) Write(b []byte) (int, error) { return 0, f.err }
+
+func TestWriterError(t *testing.T) {
+	failure := errors.New("disk full")
+	w := NewWriter(failingWriter{failure})
+	w.WriteBits32(0xabcd, 16)
+	if err := w.Flush(); err != failure {
+		t.Errorf("Flush: expected %v, got %v", failure, err)
+	}
+	// The error sticks
+	if _, err := w.WriteBits32(1, 1); err != failure {
+		t.Errorf("WriteBits32: expected %v, got %v", failure, err)
+	}
+	if err := w.Close(); err != failure {
+		t.Errorf("Close: expected %v, got %v", failure, err)
+	}
+
+	// Reset clears the error, and starts afresh
+	var buf bytes.Buffer
+	w.Reset(&buf)
+	w.WriteBits32(0x5, 3)
+	if err := w.Close(); err != nil || !bytes.Equal(buf.Bytes(), []byte{0xa0}) || w.Offset() != 8 {
+		t.Errorf("Reset: expected a0 and no error, got %x, %v", buf.Bytes(), err)
+	}
+}
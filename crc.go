@@ -0,0 +1,56 @@
+package bzip2
+
+// bzip2 uses the CRC-32 polynomial, but shifts MSB-first and doesn't reflect
+// its input or output, so hash/crc32 can't be used.
+const crcPoly = 0x04c11db7
+
+var crcTable = func() (table [256]uint32) {
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ crcPoly
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// updateCRC adds b to the running checksum crc
+func updateCRC(crc uint32, b []byte) uint32 {
+	crc = ^crc
+	for _, c := range b {
+		crc = crcTable[byte(crc>>24)^c] ^ crc<<8
+	}
+	return ^crc
+}
+
+// updateCRCRun adds n copies of c to the running checksum crc
+func updateCRCRun(crc uint32, c byte, n int) uint32 {
+	crc = ^crc
+	for ; n > 0; n-- {
+		crc = crcTable[byte(crc>>24)^c] ^ crc<<8
+	}
+	return ^crc
+}
+
+// blockCRC computes the checksum of a block's original input, given the block
+// after run-length encoding. Runs are expanded as they're checksummed, so the
+// original input never needs to be held onto.
+func blockCRC(in []byte) uint32 {
+	var crc uint32
+	expandRuns(in, func(literal []byte) {
+		crc = updateCRC(crc, literal)
+	}, func(c byte, n int) {
+		crc = updateCRCRun(crc, c, n)
+	})
+	return crc
+}
+
+// combineCRC folds a block's checksum into the stream's checksum
+func combineCRC(combined, block uint32) uint32 {
+	return (combined<<1 | combined>>31) ^ block
+}
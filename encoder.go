@@ -1,8 +1,6 @@
 package bzip2
 
 import (
-	"fmt"
-	"sort"
 	"sync"
 
 	bit "github.com/fwip/bzip2w/bit"
@@ -13,137 +11,241 @@ const (
 	bzip2BlockMagic = 0x314159265359 // BCD pi
 )
 
+const (
+	groupSize = 50 // Number of symbols coded with each selected Huffman table
+)
+
 type blockEncoder struct {
-	input    []byte
-	capacity int
-	trees    []huffman.Book
+	input  []byte
+	info   BlockInfo
+	params tableParams
+	trees  []huffman.Book
 
 	sync.WaitGroup
-	output []byte
-}
+	crc       uint32
+	origPtr   int // Row of the BWT matrix holding the input; needed to undo it
+	used      [256]bool
+	symbols   []uint16 // Huffman alphabet, ending with EOB
+	freq      []int    // Number of times each symbol occurs
+	selectors []byte
 
-func (e *blockEncoder) Write(in []byte) (n int, err error) {
-	//if e == nil {
-	//return 0, errors.New("can't write to nil encoder")
-	//}
-	if len(in)+len(e.input) > e.capacity {
-		n = e.capacity - len(e.input)
-		e.input = append(e.input, in[:n]...)
-		return n, nil
-	}
-	e.input = append(e.input, in...)
-	return len(in), nil
-}
+	// Scratch space, which is kept when the blockEncoder is reused
+	sa     saScratch
+	bwtOut []byte
+	mtfOut []byte
+	tables tableScratch
 
-func newBlockEncoder(capacity uint) *blockEncoder {
-	return &blockEncoder{
-		input:    make([]byte, 0, capacity),
-		capacity: int(capacity),
-	}
+	// Instead of a block, a request to flush everything before it
+	flush chan struct{}
 }
 
-var _ = huffman.Book{}
-
 // Transform input into encoded output
 // This shouldn't ever error.
+//
+// Each step's output goes into space left over from the last block that used
+// this blockEncoder, if there was one.
 func (e *blockEncoder) encode() {
-	//step1 := rle(e.input)
-	step2 := bwt(e.input)
-	used, step3 := mtf(step2)
-	step4 := rleMTF(step3)
-
-	fmt.Println(used)
-	fmt.Println(step4)
-	fmt.Println("Done encoding!")
-	return
+	e.crc = blockCRC(e.input)
+	e.bwtOut, e.origPtr = bwt(e.input, e.bwtOut[:0], &e.sa)
+	e.used, e.mtfOut = mtf(e.bwtOut, e.mtfOut[:0])
+	e.symbols, e.freq = rleMTF(e.mtfOut, countUsed(&e.used), e.symbols[:0])
+	e.trees, e.selectors = chooseTrees(e.symbols, e.freq, e.params, &e.tables)
 }
 
-func (e *blockEncoder) writeTo(w *bit.Writer) {
+// writeTo writes out the encoded block. Errors from w stick, so only the last
+// write needs checking.
+func (e *blockEncoder) writeTo(w *bit.Writer) (err error) {
 
 	// compressed_magic:48            = 0x314159265359 (BCD (pi))
 	w.WriteBits32(bzip2BlockMagic>>16, 32)
-	w.WriteBits32(bzip2BlockMagic&((1<<17)-1), 16)
+	w.WriteBits32(bzip2BlockMagic&((1<<16)-1), 16)
 	// .crc:32                         = checksum for this block
-	w.WriteBits32(1<<32-1, 32) //TODO
+	w.WriteBits32(e.crc, 32)
 	// .randomised:1                   = 0=>normal, 1=>randomised (deprecated)
 	w.WriteBit(0)
 	// .origPtr:24                     = starting pointer into BWT for after untransform
+	w.WriteBits32(uint32(e.origPtr), 24)
 	// .huffman_used_map:16            = bitmap, of ranges of 16 bytes, present/not present
 	// .huffman_used_bitmaps:0..256    = bitmap, of symbols used, present/not present (multiples of 16)
+	writeUsed(w, &e.used)
 	// .huffman_groups:3               = 2..6 number of different Huffman tables in use
+	w.WriteBits32(uint32(len(e.trees)), 3)
 	// .selectors_used:15              = number of times that the Huffman tables are swapped (each 50 bytes)
 	// *.selector_list:1..6            = zero-terminated bit runs (0..62) of MTF'ed Huffman table (*selectors_used)
+	writeSelectors(w, e.selectors, len(e.trees))
 	// .start_huffman_length:5         = 0..20 starting bit length for Huffman deltas
 	// *.delta_bit_length:1..40        = 0=>next symbol; 1=>alter length { 1=>decrement length; 0=>increment length } (*(symbols+2)*groups)
+	for _, tree := range e.trees {
+		tree.WriteLengths(w)
+	}
 	// .contents:2..∞                  = Huffman encoded data stream until end of block (max. 7372800 bit)
+	for i, s := range e.symbols {
+		c := e.trees[e.selectors[i/groupSize]].Codes[s]
+		_, err = w.WriteBits32(c.Val(), c.Len())
+	}
 
-	fmt.Println("Finished writing!")
+	return err
 }
 
-// TODO: Doesn't handle runs of 256 or more
-// TODO: Super inefficient (?)
-// rle = run-length encoding
-// This encoding limits the max repeat length to 4
-// Sequences of 4 or more are represented by AAAAB, where A is the byte value,
-// and B is one byte representing the number (0-255) of additional characters
-// of that value
-func rle_tmp(in []byte) (out []byte) {
-	var count byte = 1
-	for i := 1; i < len(in); i++ {
-		if in[i] == in[i-1] {
-			count++
-		}
-		if in[i] != in[i-1] {
-			for j := 0; j < 4 && j < int(count); j++ {
-				out = append(out, in[i-1])
-			}
-			if count >= 4 {
-				out = append(out, count-4)
+// writeUsed writes which bytes appear in the block. A 16-bit map says which
+// ranges of 16 bytes have any present, and only those ranges get a 16-bit map
+// of their own.
+func writeUsed(w *bit.Writer, used *[256]bool) {
+	var usedMap uint32
+	var bitmaps [16]uint32
+	for i := range bitmaps {
+		for j, u := range used[i*16 : i*16+16] {
+			if u {
+				bitmaps[i] |= 1 << uint(15-j)
 			}
-			count = 1
+		}
+		if bitmaps[i] != 0 {
+			usedMap |= 1 << uint(15-i)
 		}
 	}
-	for j := 0; j < 4 && j < int(count); j++ {
-		out = append(out, in[len(in)-1])
+
+	w.WriteBits32(usedMap, 16)
+	for _, bitmap := range bitmaps {
+		if bitmap != 0 {
+			w.WriteBits32(bitmap, 16)
+		}
 	}
-	if count >= 4 {
-		out = append(out, count-4)
+}
+
+// countUsed returns the number of distinct bytes in the block. The MTF
+// alphabet only holds those, so it sizes the Huffman alphabet too.
+func countUsed(used *[256]bool) (n int) {
+	for _, u := range used {
+		if u {
+			n++
+		}
+	}
+	return n
+}
+
+// maxRun is the longest run that RLE1 writes as a single run and count
+const maxRun = 255
+
+// rleEncoder does bzip2's initial run-length encoding. Runs of 4 to 255 of the
+// same byte are written as four of the byte, followed by a count (0-251) of
+// how many more there were; longer runs are split up. Shorter runs are left
+// as they are.
+//
+// The run at the end of the input is held back, since it might continue in
+// the next call to encode, so runs are encoded the same way however the input
+// is split up. A run and its count are always written out together, so a
+// block cut between calls never splits one, and its checksum can be worked
+// out from the block alone.
+type rleEncoder struct {
+	last byte
+	run  int // Length of the run of last that hasn't been written yet
+
+	// Length of the input that's been written out since the last call to cut
+	raw int
+}
+
+// encode appends the encoding of in to out. It stops once out reaches limit
+// bytes, and returns how much of in it used; the last run written can take
+// out up to 4 bytes past limit.
+func (r *rleEncoder) encode(out, in []byte, limit int) ([]byte, int) {
+	for i, c := range in {
+		if r.run > 0 && c == r.last && r.run < maxRun {
+			r.run++
+			continue
+		}
+		out = r.flush(out)
+		r.last, r.run = c, 1
+		if len(out) >= limit {
+			return out, i + 1
+		}
+	}
+	return out, len(in)
+}
+
+// flush appends the run that was held back to out
+func (r *rleEncoder) flush(out []byte) []byte {
+	r.raw += r.run
+	if r.run < 4 {
+		for ; r.run > 0; r.run-- {
+			out = append(out, r.last)
+		}
+		return out
 	}
+	c := r.last
+	out = append(out, c, c, c, c, byte(r.run-4))
+	r.run = 0
 	return out
 }
 
-// TODO: This is super slow for large inputs
+// cut returns the length of the input written out since the last call, for
+// the block that's just been filled
+func (r *rleEncoder) cut() (raw int) {
+	raw, r.raw = r.raw, 0
+	return raw
+}
+
 // bwt = burrows-wheeler transform
 // This is the meat of the compression algorithm
-func bwt(in []byte) (out []byte) {
-	matrix := make([]string, len(in))
-	for i := range in {
-		matrix[i] = string(in[len(in)-i:]) + string(in[:len(in)-i])
+// origPtr is the row of the sorted rotation matrix holding the original input
+//
+// Sorting the rotations of the input is the same as sorting the suffixes of
+// the input repeated twice, as long as we only keep the suffixes that start in
+// the first copy. Rotations that compare equal produce the same output, so
+// their relative order doesn't matter.
+//
+// The output is appended to out, and the suffix array is built in scratch,
+// which can be nil.
+func bwt(in, out []byte, scratch *saScratch) ([]byte, int) {
+	if scratch != nil {
+		scratch.reset()
 	}
-	sort.Strings(matrix)
-	for i := range in {
-		out = append(out, matrix[i][len(in)-1])
+	n := len(in)
+	doubled := scratch.int32s(2 * n)
+	for i, c := range in {
+		doubled[i] = int32(c)
+		doubled[i+n] = int32(c)
 	}
-	return out
+	sa := suffixArray(doubled, 255, scratch)
+
+	var origPtr int
+	for _, p := range sa {
+		if int(p) >= n {
+			continue
+		}
+		if p == 0 {
+			origPtr = len(out)
+			out = append(out, in[n-1])
+			continue
+		}
+		out = append(out, in[p-1])
+	}
+	return out, origPtr
 }
 
 // mtf = move-to-front transform
-// TODO: Likely slow
-func mtf(in []byte) (used [256]bool, out []byte) {
+// The list starts out holding just the bytes used in the input, in order.
+// The output is appended to out.
+func mtf(in, out []byte) (used [256]bool, _ []byte) {
 
 	for _, c := range in {
 		used[c] = true
 	}
 
-	frontlist := [256]byte{}
-	var count int
+	frontlist := make([]byte, 0, 256)
 	for i := 0; i < 256; i++ {
 		if used[i] {
-			frontlist[count] = byte(i)
-			count++
+			frontlist = append(frontlist, byte(i))
 		}
 	}
 
+	return used, moveToFront(in, frontlist, out)
+}
+
+// moveToFront replaces each byte of the input with its position in frontlist,
+// then moves it to the front of the list. Every input byte must be somewhere
+// in frontlist, which is modified. The output is appended to out.
+// TODO: Likely slow
+func moveToFront(in []byte, frontlist []byte, out []byte) []byte {
 	// Walk the input string
 	for _, c := range in {
 		// Find the character in the list
@@ -158,43 +260,60 @@ func mtf(in []byte) (used [256]bool, out []byte) {
 		}
 	}
 
-	return used, out
+	return out
+}
+
+// unMoveToFront inverts moveToFront, given the same initial frontlist
+func unMoveToFront(in []byte, frontlist []byte) (out []byte) {
+	out = make([]byte, 0, len(in))
+	for _, i := range in {
+		d := frontlist[i]
+		copy(frontlist[1:i+1], frontlist[:i])
+		frontlist[0] = d
+		out = append(out, d)
+	}
+	return out
 }
 
 // This encodes runs of zeroes specially (RUNA=0, RUNB=1)
 // And adds 1 to everything else
+// The output ends with the end-of-block symbol (numUsed+1), and freq counts
+// how often each of the numUsed+2 symbols occurs.
 // This should probably be a part of mtf, to be honest
-func rleMTF(in []byte) (out []uint16) {
-	var count uint16
-	var place uint16
+func rleMTF(in []byte, numUsed int, out []uint16) (_ []uint16, freq []int) {
+	freq = make([]int, numUsed+2)
+	emit := func(s uint16) {
+		out = append(out, s)
+		freq[s]++
+	}
+	// Runs are written in bijective base 2, least significant digit first,
+	// where RUNA is a 1 and RUNB is a 2
+	var count int
+	emitRun := func() {
+		for place := 1; count > 0; place <<= 1 {
+			if count&place != 0 {
+				count -= place
+				emit(runA)
+			} else {
+				count -= place * 2
+				emit(runB)
+			}
+		}
+		if count != 0 {
+			panic("Count should definitely be zero")
+		}
+	}
+
 	for _, c := range in {
 		if c == 0 {
 			count++
 		} else {
-			for place = 1; count > 0; place <<= 1 {
-				if count&place != 0 {
-					count -= place
-					out = append(out, runA)
-				} else {
-					count -= place * 2
-					out = append(out, runB)
-				}
-			}
-			if count != 0 {
-				panic("Count should definitely be zero")
-			}
-			out = append(out, uint16(c)+1)
+			emitRun()
+			emit(uint16(c) + 1)
 		}
 	}
 	// In case we end with zeroes
-	for place = 1; count > 0; place <<= 1 {
-		if count&place != 0 {
-			count -= place
-			out = append(out, runA)
-		} else {
-			count -= place * 2
-			out = append(out, runB)
-		}
-	}
-	return out
+	emitRun()
+	emit(uint16(numUsed + 1))
+	return out, freq
 }
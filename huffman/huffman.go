@@ -2,10 +2,32 @@ package bzip2
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"sort"
+
+	bit "github.com/fwip/bzip2w/bit"
 )
 
+// maxFormatBits is the longest code the bzip2 format can describe
+const maxFormatBits = 20
+
+// ErrBadLength is returned when a serialized Book has a code length outside
+// the range allowed by the format.
+var ErrBadLength = errors.New("huffman: code length out of range")
+
+// BitReader reads bits, MSB-first
+type BitReader interface {
+	ReadBits32(count uint) (uint32, error)
+}
+
+// PeekBitReader is a BitReader that can look at upcoming bits without reading
+// them. Missing bits past the end of the input should be zero.
+type PeekBitReader interface {
+	BitReader
+	PeekBits(count uint) (uint32, error)
+}
+
 type Book struct {
 	Codes []Code
 }
@@ -25,238 +47,301 @@ func (c Code) String() string {
 	return fmt.Sprintf("%0[2]*[1]b", c.val, int(c.bits))
 }
 
-func (nl nodeList) search(freq int) int {
-	min := 0
-	max := len(nl) - 1
-	test := 0
-	for min < max {
-		test = max + min/2
-		testn := nl[test].freq
-		switch {
-		case testn == freq:
-			return test
-		case testn < freq:
-			min = test + 1
-		case testn > freq:
-			max = test - 1
-		}
-	}
-	return test
+// Val returns the code's bits, right-aligned
+func (c Code) Val() uint32 { return c.val }
+
+// Len returns the number of bits in the code
+func (c Code) Len() uint { return uint(c.bits) }
+
+// MaxBits is the longest code NewBook will generate. The format allows up to
+// 20 bits, but the reference encoder never goes over 17.
+const MaxBits = 17
+
+// NewBook generates an optimal set of canonical codes for the given symbol
+// frequencies, no longer than MaxBits. Every symbol gets a code, even if its
+// frequency is zero.
+func NewBook(freq []int) Book {
+	return NewLimitedBook(freq, MaxBits)
 }
 
-func (n node) String() (out string) {
-	if n.children == nil {
-		return fmt.Sprintf("%d~%d", n.freq, n.val)
+// NewLimitedBook is like NewBook, but limits codes to maxBits bits. maxBits
+// must be large enough to give every symbol a code (1<<maxBits >= len(freq)).
+func NewLimitedBook(freq []int, maxBits int) Book {
+	if len(freq) > 1<<uint(maxBits) {
+		panic(fmt.Sprintf("huffman: can't fit %d codes in %d bits", len(freq), maxBits))
 	}
-	return fmt.Sprintf("%d(%s %s)", n.freq, n.children[0], n.children[1])
+	var b Builder
+	return bookFromLengths(b.packageMerge(freq, maxBits), nil)
 }
 
-// Warning; Destructive! Modifies the input slice.
-func buildTree(nodes []node) node {
-	sort.Sort(nodeList(nodes))
-	for len(nodes) > 1 {
-		n := combineNodes(nodes[0], nodes[1])
-		switch {
-		case len(nodes) == 2:
-			nodes[1] = n
-		case n.freq <= nodes[2].freq:
-			nodes[1] = n
-		case n.freq >= nodes[len(nodes)-1].freq:
-			copy(nodes[1:len(nodes)-1], nodes[2:])
-			nodes[len(nodes)-1] = n
-		default:
-			idx := nodeList(nodes).search(n.freq)
-			copy(nodes[:idx], nodes[1:idx+1])
-			nodes[idx] = n
+// A Builder makes Books like NewBook does, but keeps its working space to
+// reuse for the next one. The zero value is ready to use.
+type Builder struct {
+	leaves  []item
+	lists   [][]item
+	lengths []byte
+}
 
-		}
-		nodes = nodes[1:]
+// Rebuild is like NewBook, but reuses the Builder's working space, and the
+// codes of book, which are overwritten
+func (b *Builder) Rebuild(book Book, freq []int) Book {
+	if len(freq) > 1<<MaxBits {
+		panic(fmt.Sprintf("huffman: can't fit %d codes in %d bits", len(freq), MaxBits))
 	}
+	return bookFromLengths(b.packageMerge(freq, MaxBits), book.Codes)
+}
 
-	return nodes[0]
+// item is either a symbol, or a package of two items from the previous list
+type item struct {
+	weight      int
+	sym         int // -1 for packages
+	left, right int // Indices into the previous list
 }
 
-// Slower but simpler implementation
-func buildTreeSlowly(nodes []node) node {
-	for len(nodes) > 1 {
-		sort.Sort(nodeList(nodes)) // TODO: This is dang slow.
-		n := combineNodes(nodes[0], nodes[1])
-		nodes = nodes[1:]
-		nodes[0] = n
+// packageMerge finds the optimal code lengths, limited to maxBits, using the
+// package-merge algorithm (Larmore & Hirschberg, 1990). The lengths are only
+// valid until the Builder is used again.
+func (b *Builder) packageMerge(freq []int, maxBits int) (lengths []byte) {
+	n := len(freq)
+	if cap(b.lengths) < n {
+		b.lengths = make([]byte, n)
+	}
+	lengths = b.lengths[:n]
+	for i := range lengths {
+		lengths[i] = 0
+	}
+	switch n {
+	case 0:
+		return lengths
+	case 1:
+		lengths[0] = 1
+		return lengths
 	}
-	return nodes[0]
 
-}
+	if cap(b.leaves) < n {
+		b.leaves = make([]item, n)
+	}
+	leaves := b.leaves[:n]
+	for i, f := range freq {
+		leaves[i] = item{weight: f, sym: i}
+	}
+	sort.SliceStable(leaves, func(a, b int) bool { return leaves[a].weight < leaves[b].weight })
 
-// Takes a node (tree) and a length (number of leaves in the tree) and returns
-// a new Book with the canonical encodings
-func genBookFromTree(n node, length int) Book {
-	var book Book
-	book.Codes = make([]Code, length)
-	levels := make([][]node, 0, 20)
-	levels = append(levels, []node{n})
-
-	var count int32 = -1
-	bitLength := 0
-	for i := 0; i < len(levels); i++ {
-		sort.Sort(byVal(levels[i]))
-		for _, n := range levels[i] {
-			if n.children != nil {
-				if len(levels) == i+1 {
-					//levels = append(levels, nil)
-					levels = append(levels, make([]node, 0, 2*len(levels[len(levels)-1])))
+	// Each list pairs up the items of the previous one, and merges those
+	// packages in with the original symbols
+	for len(b.lists) < maxBits {
+		b.lists = append(b.lists, nil)
+	}
+	lists := b.lists[:maxBits]
+	lists[0] = leaves
+	for l := 1; l < maxBits; l++ {
+		prev := lists[l-1]
+		list := lists[l][:0]
+		i, j := 0, 0
+		for i < n || j+1 < len(prev) {
+			if j+1 < len(prev) {
+				pkg := item{weight: prev[j].weight + prev[j+1].weight, sym: -1, left: j, right: j + 1}
+				if i == n || pkg.weight < leaves[i].weight {
+					list = append(list, pkg)
+					j += 2
+					continue
 				}
-				levels[i+1] = append(levels[i+1], n.children[0])
-				levels[i+1] = append(levels[i+1], n.children[1])
-			} else {
-				count = (count + 1) << uint(i-bitLength)
-				bitLength = i
-				book.Codes[n.val] = Code{bits: byte(i), val: uint32(count)}
 			}
+			list = append(list, leaves[i])
+			i++
 		}
+		lists[l] = list
 	}
 
-	return book
+	// The cheapest 2n-2 items in the last list make up the code; each time a
+	// symbol appears in them lengthens its code by one bit.
+	var count func(l, idx int)
+	count = func(l, idx int) {
+		it := lists[l][idx]
+		if it.sym >= 0 {
+			lengths[it.sym]++
+			return
+		}
+		count(l-1, it.left)
+		count(l-1, it.right)
+	}
+	for idx := 0; idx < 2*n-2; idx++ {
+		count(maxBits-1, idx)
+	}
+
+	return lengths
 }
 
-func NewBook(freq []int) Book {
-	// Generate the nodes
-	nodes := make([]node, 0, len(freq))
-	for v, f := range freq {
-		nodes = append(nodes, node{val: v, freq: f})
+// bookFromLengths assigns canonical codes: shorter codes come first, and codes
+// of the same length are ordered by symbol. The codes are stored in codes, if
+// there's room.
+func bookFromLengths(lengths []byte, codes []Code) Book {
+	var book Book
+	if cap(codes) < len(lengths) {
+		codes = make([]Code, len(lengths))
+	}
+	book.Codes = codes[:len(lengths)]
+	for i := range book.Codes {
+		book.Codes[i] = Code{}
 	}
 
-	// Order the nodes
-	n := buildTree(nodes)
-
-	// TODO: Enforce maximum length of 17 (or 20, TBD)
+	var maxLen byte
+	for _, l := range lengths {
+		if l > maxLen {
+			maxLen = l
+		}
+	}
 
-	// Canonicalize the tree
-	book := genBookFromTree(n, len(freq))
+	var code uint32
+	for l := byte(1); l <= maxLen; l++ {
+		for sym, symLen := range lengths {
+			if symLen == l {
+				book.Codes[sym] = Code{val: code, bits: l}
+				code++
+			}
+		}
+		code <<= 1
+	}
 
 	return book
 }
 
-type node struct {
-	val      int
-	freq     int
-	children []node
+// WriteLengths writes the length of each code in the Book, delta-encoded as in
+// bzip2: a 5-bit starting length, then for each symbol, a 1 followed by a 0
+// (to increment) or a 1 (to decrement) as many times as needed, then a 0.
+func (b Book) WriteLengths(w *bit.Writer) (err error) {
+	if len(b.Codes) == 0 {
+		return nil
+	}
+	length := b.Codes[0].bits
+	if _, err = w.WriteBits32(uint32(length), 5); err != nil {
+		return err
+	}
+	for _, c := range b.Codes {
+		for ; length < c.bits; length++ {
+			if _, err = w.WriteBits32(2, 2); err != nil {
+				return err
+			}
+		}
+		for ; length > c.bits; length-- {
+			if _, err = w.WriteBits32(3, 2); err != nil {
+				return err
+			}
+		}
+		if err = w.WriteBit(0); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-type nodeList []node
-
-func (nl nodeList) Len() int      { return len(nl) }
-func (nl nodeList) Swap(a, b int) { nl[a], nl[b] = nl[b], nl[a] }
-func (nl nodeList) Less(a, b int) bool {
-	return nl[a].freq < nl[b].freq
+// ReadLengths reads the code lengths of alphaSize symbols, as written by
+// WriteLengths, and returns the Book of canonical codes they describe.
+func ReadLengths(r BitReader, alphaSize int) (Book, error) {
+	lengths := make([]byte, alphaSize)
+	length, err := r.ReadBits32(5)
+	if err != nil {
+		return Book{}, err
+	}
+	for i := range lengths {
+		for {
+			if length < 1 || length > maxFormatBits {
+				return Book{}, ErrBadLength
+			}
+			alter, err := r.ReadBits32(1)
+			if err != nil {
+				return Book{}, err
+			}
+			if alter == 0 {
+				break
+			}
+			decrement, err := r.ReadBits32(1)
+			if err != nil {
+				return Book{}, err
+			}
+			if decrement == 1 {
+				length--
+			} else {
+				length++
+			}
+		}
+		lengths[i] = byte(length)
+	}
+	return bookFromLengths(lengths, nil), nil
 }
 
-type byVal []node
+// ErrBadCode is returned when the input doesn't match any code in a Decoder
+var ErrBadCode = errors.New("huffman: invalid code")
 
-func (nl byVal) Len() int      { return len(nl) }
-func (nl byVal) Swap(a, b int) { nl[a], nl[b] = nl[b], nl[a] }
-func (nl byVal) Less(a, b int) bool {
-	return nl[a].val < nl[b].val
+// Decoder reads symbols coded with a canonical Book
+type Decoder struct {
+	maxLen int
+	first  [maxFormatBits + 1]int // First code of each length
+	count  [maxFormatBits + 1]int // Number of codes of each length
+	offset [maxFormatBits + 1]int // Index into perm of the first code of each length
+	perm   []int                  // Symbols, ordered by code
 }
 
-func combineNodes(a, b node) node {
-	return node{freq: a.freq + b.freq, children: []node{a, b}}
-}
-
-/*
-func (n node) canonicalize() (bits []byte) {
-	bits = make([]byte, 258)
-	levels := [][]node{[]node{n}}
-	for i := 0; i < len(levels); i++ {
-		for _, n := range levels[i] {
-			if n.children != nil {
-				levels[i+1] = append(levels[i+1], n.children[0])
-				levels[i+1] = append(levels[i+1], n.children[1])
-			} else {
-				bits[n.val] = byte(i)
+// NewDecoder creates a Decoder for the canonical codes in b, such as those
+// from ReadLengths
+func NewDecoder(b Book) *Decoder {
+	d := &Decoder{perm: make([]int, 0, len(b.Codes))}
+	for l := 1; l <= maxFormatBits; l++ {
+		d.offset[l] = len(d.perm)
+		for sym, c := range b.Codes {
+			if int(c.bits) != l {
+				continue
 			}
+			if d.count[l] == 0 {
+				d.first[l] = int(c.val)
+			}
+			d.count[l]++
+			d.perm = append(d.perm, sym)
+			d.maxLen = l
+		}
+		if d.count[l] == 0 && l > 1 {
+			d.first[l] = (d.first[l-1] + d.count[l-1]) << 1
 		}
 	}
-
-	return bits
+	return d
 }
 
-func (n node) getCodes() (out map[int]string) {
-	out = make(map[int]string)
-	if n.children == nil {
-		out[n.val] = ""
-		return out
-	}
-	for val, code := range n.children[0].getCodes() {
-		out[val] = "0" + code
+// Decode reads a single symbol
+func (d *Decoder) Decode(r BitReader) (sym int, err error) {
+	if pr, ok := r.(PeekBitReader); ok {
+		return d.decodePeek(pr)
 	}
-	for val, code := range n.children[1].getCodes() {
-		out[val] = "1" + code
-	}
-	return out
-}
 
-
-func freqs(nodes []node) (freqs []int) {
-	for _, n := range nodes {
-		freqs = append(freqs, n.freq)
+	code := 0
+	for l := 1; l <= d.maxLen; l++ {
+		b, err := r.ReadBits32(1)
+		if err != nil {
+			return 0, err
+		}
+		code = code<<1 | int(b)
+		if idx := code - d.first[l]; idx >= 0 && idx < d.count[l] {
+			return d.perm[d.offset[l]+idx], nil
+		}
 	}
-	return freqs
+	return 0, ErrBadCode
 }
 
-func buildTree(freq []int) node {
-	nodes := make([]node, 0, len(freq))
-	for v, f := range freq {
-		nodes = append(nodes, node{val: v, freq: f})
+// decodePeek looks at enough bits for the longest code at once, and only
+// reads as many as the matching code needs
+func (d *Decoder) decodePeek(r PeekBitReader) (sym int, err error) {
+	bits, peekErr := r.PeekBits(uint(d.maxLen))
+	for l := 1; l <= d.maxLen; l++ {
+		code := int(bits >> uint(d.maxLen-l))
+		if idx := code - d.first[l]; idx >= 0 && idx < d.count[l] {
+			// Fails if the input ended partway through the code
+			if _, err := r.ReadBits32(uint(l)); err != nil {
+				return 0, err
+			}
+			return d.perm[d.offset[l]+idx], nil
+		}
 	}
-*/
-
-//
-//// Something wrong with this
-//	sort.Sort(nodeList(nodes))
-//	for len(nodes) > 1 {
-//		n := combineNodes(nodes[0], nodes[1])
-//
-//		min := 2
-//		max := len(nodes) - 1
-//		var test int
-//		switch {
-//		case len(nodes) == 2 || n.freq <= nodes[2].freq:
-//			nodes[1] = n
-//		case n.freq >= nodes[len(nodes)-1].freq:
-//			copy(nodes[1:len(nodes)-1], nodes[2:])
-//			nodes[len(nodes)-1] = n
-//
-//		default:
-//			for min < max {
-//				test = (max + min) / 2
-//				tf := nodes[test].freq
-//				if tf == n.freq {
-//					break
-//				}
-//				if tf < n.freq {
-//					min = test + 1
-//					continue
-//				}
-//				max = test - 1
-//			}
-//		}
-//		nodes = nodes[1:]
-//
-//		//if !sort.IsSorted(nodeList(nodes)) {
-//		//panic("Not sorted")
-//		//}
-//
-//	}
-//
-/*
-	for len(nodes) > 1 {
-		sort.Sort(nodeList(nodes)) // TODO: This is slow.
-		n := combineNodes(nodes[0], nodes[1])
-		nodes = nodes[1:]
-		nodes[0] = n
+	if peekErr != nil {
+		return 0, peekErr
 	}
-
-	return nodes[0]
+	return 0, ErrBadCode
 }
-*/
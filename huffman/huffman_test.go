@@ -1,8 +1,12 @@
 package bzip2
 
 import (
+	"bytes"
+	"io"
 	"math/rand"
 	"testing"
+
+	bit "github.com/fwip/bzip2w/bit"
 )
 
 var bookTests = []struct {
@@ -44,6 +48,135 @@ func TestNewBook(t *testing.T) {
 	*/
 }
 
+// kraft returns the sum of 2^-len over all codes, scaled by 2^maxBits.
+// A complete prefix code sums to exactly 1<<maxBits.
+func kraft(book Book, maxBits uint) (sum int) {
+	for _, c := range book.Codes {
+		sum += 1 << (maxBits - uint(c.bits))
+	}
+	return sum
+}
+
+func TestNewLimitedBook(t *testing.T) {
+	// Fibonacci frequencies make the deepest possible trees
+	fib := []int{1, 1}
+	for len(fib) < 30 {
+		fib = append(fib, fib[len(fib)-1]+fib[len(fib)-2])
+	}
+
+	tests := []struct {
+		freq    []int
+		maxBits int
+	}{
+		{fib, 20},
+		{fib, 17},
+		{fib, 5},
+		{[]int{1000, 6, 5, 10, 1}, 3},
+		{[]int{0, 0, 0, 50, 0}, 17},
+		{make([]int, 258), 17},
+	}
+	for _, test := range tests {
+		book := NewLimitedBook(test.freq, test.maxBits)
+		if len(book.Codes) != len(test.freq) {
+			t.Errorf("Expected %d codes, got %d", len(test.freq), len(book.Codes))
+			continue
+		}
+		for i, c := range book.Codes {
+			if c.bits < 1 || int(c.bits) > test.maxBits {
+				t.Errorf("NewLimitedBook(%v, %d).Codes[%d] => %s, longer than allowed", test.freq, test.maxBits, i, c)
+			}
+		}
+		if sum := kraft(book, uint(test.maxBits)); sum != 1<<uint(test.maxBits) {
+			t.Errorf("NewLimitedBook(%v, %d) isn't a complete code:\n%s", test.freq, test.maxBits, book)
+		}
+	}
+
+	// Without a limit, the deepest Fibonacci code is as long as the alphabet
+	book := NewLimitedBook(fib, 30)
+	if bits := book.Codes[0].bits; bits != 29 {
+		t.Errorf("NewLimitedBook(fib, 30).Codes[0] has %d bits, want 29", bits)
+	}
+
+	// A single symbol still needs a code
+	book = NewBook([]int{5})
+	if len(book.Codes) != 1 || book.Codes[0].bits != 1 {
+		t.Errorf("NewBook([5]) => %v, want a single 1-bit code", book.Codes)
+	}
+}
+
+// byteBitReader reads bits from a byte slice, MSB-first
+type byteBitReader struct {
+	b   []byte
+	pos int
+}
+
+func (r *byteBitReader) ReadBits32(count uint) (v uint32, err error) {
+	for ; count > 0; count-- {
+		if r.pos>>3 >= len(r.b) {
+			return v, io.ErrUnexpectedEOF
+		}
+		v = v<<1 | uint32(r.b[r.pos>>3]>>(7-uint(r.pos&7))&1)
+		r.pos++
+	}
+	return v, nil
+}
+
+func TestLengths(t *testing.T) {
+	freqs := [][]int{
+		{10, 5, 2, 1},
+		{1000, 6, 5, 10, 1},
+		{0, 0, 0, 50, 0},
+		make([]int, 258),
+	}
+	random := make([]int, 258)
+	for i := range random {
+		random[i] = rand.Intn(3000)
+	}
+	freqs = append(freqs, random)
+
+	for _, freq := range freqs {
+		book := NewBook(freq)
+		var buf bytes.Buffer
+		w := bit.NewWriter(&buf)
+		if err := book.WriteLengths(w); err != nil {
+			t.Fatalf("WriteLengths: %v", err)
+		}
+		w.Close()
+
+		read, err := ReadLengths(&byteBitReader{b: buf.Bytes()}, len(freq))
+		if err != nil {
+			t.Errorf("ReadLengths(%v): %v", freq, err)
+			continue
+		}
+		for i := range book.Codes {
+			if book.Codes[i] != read.Codes[i] {
+				t.Errorf("ReadLengths(%v).Codes[%d] => %s, want %s", freq, i, read.Codes[i], book.Codes[i])
+			}
+		}
+	}
+
+	// A starting length of zero is out of range
+	if _, err := ReadLengths(&byteBitReader{b: []byte{0, 0}}, 3); err != ErrBadLength {
+		t.Errorf("ReadLengths: expected ErrBadLength, got %v", err)
+	}
+}
+
+func TestBuilder(t *testing.T) {
+	// Books of different sizes, each built over the last
+	var b Builder
+	var book Book
+	for _, n := range []int{258, 3, 40, 1, 258} {
+		freq := make([]int, n)
+		for i := range freq {
+			freq[i] = rand.Intn(1000)
+		}
+		book = b.Rebuild(book, freq)
+		if expected := NewBook(freq); book.String() != expected.String() {
+			t.Errorf("Rebuild(%v):\n%s\nwant:\n%s", freq, book, expected)
+		}
+	}
+}
+
 func BenchmarkNewBook(b *testing.B) {
 	in := make([]int, 258)
 	for i := 0; i < len(in); i++ {
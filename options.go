@@ -0,0 +1,82 @@
+package bzip2
+
+import (
+	"errors"
+	"io"
+)
+
+// An Option configures a Writer created by NewWriterOptions
+type Option func(*Writer) error
+
+// NewWriterOptions is like NewWriter, but applies the given options. Each one
+// is checked before anything is written, and the first invalid option's error
+// is returned.
+//
+// There's no option for the reference encoder's -workFactor, which sets how
+// hard its block sorter tries before falling back to a slower one: blocks here
+// are sorted with suffix arrays, which take linear time on any data, so there's
+// nothing to fall back to. Nor is there one asking for deterministic output,
+// since the output only ever depends on the input, the options, and where
+// Flush is called; never on concurrency or on how the input is split between
+// calls to Write.
+func NewWriterOptions(w io.Writer, opts ...Option) (*Writer, error) {
+	writer := NewWriter(w)
+	for _, opt := range opts {
+		if err := opt(writer); err != nil {
+			return nil, err
+		}
+	}
+	return writer, nil
+}
+
+// BlockSize sets the block size to n * 100KB, for n from 1-9. It defaults to 9.
+func BlockSize(n int) Option {
+	return func(w *Writer) error {
+		return w.SetBlockSize(n)
+	}
+}
+
+// Concurrency sets how many blocks are compressed at once, as SetConcurrency
+// does
+func Concurrency(n int) Option {
+	return func(w *Writer) error {
+		return w.SetConcurrency(n)
+	}
+}
+
+// HuffmanTables sets how many Huffman tables each block uses, from 2-6. Using
+// 0 picks a number to suit the size of each block, which is the default.
+func HuffmanTables(n int) Option {
+	return func(w *Writer) error {
+		if n != 0 && (n < minTrees || n > maxTrees) {
+			return errors.New("invalid number of Huffman tables")
+		}
+		w.tables.nTrees = n
+		return nil
+	}
+}
+
+// HuffmanIterations sets how many passes are spent fitting the Huffman tables
+// to each block. It defaults to 4, as in the reference encoder; more passes
+// are slower, and rarely make the output much smaller.
+func HuffmanIterations(n int) Option {
+	return func(w *Writer) error {
+		if n < 1 {
+			return errors.New("invalid number of Huffman iterations")
+		}
+		w.tables.iters = n
+		return nil
+	}
+}
+
+// Trace has the Writer report its progress to t. Passing nil turns tracing
+// off, which is the default.
+func Trace(t Tracer) Option {
+	return func(w *Writer) error {
+		if t == nil {
+			t = nopTracer{}
+		}
+		w.tracer = t
+		return nil
+	}
+}
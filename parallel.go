@@ -0,0 +1,294 @@
+package bzip2
+
+import (
+	"bytes"
+	"io"
+	"runtime"
+
+	bit "github.com/fwip/bzip2w/bit"
+)
+
+const magicMask = 1<<48 - 1
+
+// maxBlockBytes bounds how much compressed data a block can take up: every
+// symbol has a code of at most 20 bits, and the block's header is much smaller
+// than the extra room given here.
+func maxBlockBytes(blockSize int) int {
+	return (blockSize+1)*20/8 + 1<<17
+}
+
+// blockResult is a speculatively decompressed block
+type blockResult struct {
+	out []byte
+	crc uint32
+	end int64 // Bit offset just past the end of the block
+	err error
+}
+
+// blockKey identifies a speculatively decompressed block. A block's size limit
+// comes from the header of the stream it's in, so a block decompressed with
+// the wrong limit can't be used.
+type blockKey struct {
+	off       int64 // Bit offset of the block's magic number
+	blockSize int
+}
+
+// parallelReader decompresses several blocks at once. Blocks are independent,
+// and each starts with a 48-bit magic number at some bit offset, so the reader
+// searches ahead for those magic numbers and starts decompressing from each.
+// Output is assembled in order by following each real block to where it ends,
+// so a magic number that turns up by chance inside a block is never used.
+type parallelReader struct {
+	r       io.Reader
+	workers int
+	sem     chan struct{} // Limits how many blocks are decompressed at once
+
+	buf  []byte // Compressed data, starting at byte offset base
+	base int64
+	eof  bool // Whether r has run out of data
+
+	pos         int64                         // Bit offset of the next thing to read
+	scannedByte int64                         // Byte up to which magic numbers have been searched for
+	pending     map[blockKey]chan blockResult // Blocks being decompressed
+	started     int                           // Number of blocks started, spurious ones included
+
+	stream
+	out []byte
+	err error
+}
+
+// NewParallelReader is like NewReader, but decompresses up to workers blocks
+// at once. If workers < 1, it uses runtime.GOMAXPROCS(0).
+//
+// It reads ahead by workers times the largest size a compressed block could
+// be (about 2.4MB for 900k blocks), and holds that much in memory.
+func NewParallelReader(r io.Reader, workers int) io.ReadCloser {
+	if workers < 1 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	return &parallelReader{
+		r:       r,
+		workers: workers,
+		sem:     make(chan struct{}, workers),
+		pending: make(map[blockKey]chan blockResult),
+	}
+}
+
+// Read decompresses data into p
+func (r *parallelReader) Read(p []byte) (n int, err error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.nextBlock()
+	}
+	n = copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// Close stops any further reads. Blocks that are already being decompressed
+// are finished and thrown away. It doesn't close the underlying io.Reader.
+func (r *parallelReader) Close() error {
+	r.out = nil
+	r.pending = nil
+	if r.err == nil || r.err == io.EOF {
+		r.err = errReaderClosed
+	}
+	return nil
+}
+
+// fill reads from r until the buffer holds everything before byte offset end,
+// or there's nothing left to read
+func (r *parallelReader) fill(end int64) error {
+	for !r.eof && r.base+int64(len(r.buf)) < end {
+		if len(r.buf) == cap(r.buf) {
+			// Blocks being decompressed may still refer to the old buffer, so
+			// it's never written to again
+			buf := make([]byte, len(r.buf), 2*cap(r.buf)+4096)
+			copy(buf, r.buf)
+			r.buf = buf
+		}
+		n, err := r.r.Read(r.buf[len(r.buf):cap(r.buf)])
+		r.buf = r.buf[:len(r.buf)+n]
+		if err == io.EOF {
+			r.eof = true
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bits reads count bits at bit offset pos, returning io.ErrUnexpectedEOF if
+// they're past the end of the input
+func (r *parallelReader) bits(pos int64, count uint) (v uint64, err error) {
+	end := (pos + int64(count) + 7) / 8
+	if err := r.fill(end); err != nil {
+		return 0, err
+	}
+	if end > r.base+int64(len(r.buf)) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	for p := pos - r.base*8; count > 0; count-- {
+		v = v<<1 | uint64(r.buf[p>>3]>>(7-uint(p&7))&1)
+		p++
+	}
+	return v, nil
+}
+
+// nextBlock finds the decompressed block at r.pos and puts it in r.out,
+// reading stream headers and trailers as it comes to them
+func (r *parallelReader) nextBlock() error {
+	for {
+		if !r.inStream {
+			if err := r.readHeader(); err != nil {
+				return err
+			}
+		}
+
+		magic, err := r.bits(r.pos, 48)
+		if err != nil {
+			return err
+		}
+		switch magic {
+		case bzip2BlockMagic:
+			if err := r.lookahead(); err != nil {
+				return err
+			}
+			key := blockKey{r.pos, r.blockSize}
+			pending, ok := r.pending[key]
+			if !ok {
+				return StructuralError("block wasn't found")
+			}
+			res := <-pending
+			delete(r.pending, key)
+			if res.err != nil {
+				return res.err
+			}
+			r.crc = combineCRC(r.crc, res.crc)
+			r.pos = res.end
+			r.out = res.out
+			r.compact()
+			return nil
+		case bzip2FinalMagic:
+			want, err := r.bits(r.pos+48, 32)
+			if err != nil {
+				return err
+			}
+			if err := r.endStream(uint32(want)); err != nil {
+				return err
+			}
+			r.pos = (r.pos + 48 + 32 + 7) &^ 7
+		default:
+			return StructuralError("bad magic value")
+		}
+	}
+}
+
+// readHeader reads the "BZh" magic and block size that start a stream
+func (r *parallelReader) readHeader() error {
+	if err := r.fill(r.pos/8 + 1); err != nil {
+		return err
+	}
+	if r.streams > 0 && r.pos/8 >= r.base+int64(len(r.buf)) {
+		return io.EOF
+	}
+	header, err := r.bits(r.pos, 32)
+	if err != nil {
+		return err
+	}
+	lastSize := r.blockSize
+	if err := r.startStream(uint32(header)); err != nil {
+		return err
+	}
+	r.pos += 32
+	// Blocks found past the end of the last stream are still good if this one
+	// has the same block size. Otherwise lookahead drops them, and they have
+	// to be found again.
+	if r.blockSize != lastSize {
+		r.scannedByte = 0
+	}
+	return nil
+}
+
+// lookahead searches for block magic numbers from r.pos onwards, and starts
+// decompressing from each one, keeping 2*workers blocks in flight. Blocks
+// behind r.pos, or started with another stream's block size, are dropped.
+func (r *parallelReader) lookahead() error {
+	for key := range r.pending {
+		if key.off < r.pos || key.blockSize != r.blockSize {
+			delete(r.pending, key)
+		}
+	}
+	if err := r.fill(r.pos/8 + int64(r.workers*maxBlockBytes(r.blockSize))); err != nil {
+		return err
+	}
+	if start := r.pos / 8; r.scannedByte < start {
+		r.scannedByte = start
+	}
+
+	// window holds the 8 bytes ending with byte b. Bytes that have been
+	// dropped from the buffer come before r.pos, so they can be left as zero.
+	var window uint64
+	for b := r.scannedByte - 7; b < r.scannedByte; b++ {
+		window <<= 8
+		if b >= r.base {
+			window |= uint64(r.buf[b-r.base])
+		}
+	}
+
+	end := r.base + int64(len(r.buf))
+	for b := r.scannedByte; b < end; b++ {
+		window = window<<8 | uint64(r.buf[b-r.base])
+		// Check each magic number that would end in this byte
+		for k := uint(8); k > 0; k-- {
+			off := (b+1)*8 - 48 - int64(k-1)
+			if off < r.pos || (window>>(k-1))&magicMask != bzip2BlockMagic {
+				continue
+			}
+			if _, ok := r.pending[blockKey{off, r.blockSize}]; ok {
+				continue
+			}
+			if len(r.pending) >= 2*r.workers || (!r.eof && off/8+int64(maxBlockBytes(r.blockSize)) > end) {
+				r.scannedByte = b
+				return nil
+			}
+			r.start(off)
+		}
+	}
+	r.scannedByte = end
+	return nil
+}
+
+// start decompresses the block whose magic number is at bit offset off
+func (r *parallelReader) start(off int64) {
+	res := make(chan blockResult, 1)
+	blockSize := r.blockSize
+	r.pending[blockKey{off, blockSize}] = res
+	r.started++
+	data, base := r.buf, r.base*8
+	go func() {
+		r.sem <- struct{}{}
+		defer func() { <-r.sem }()
+
+		// Start just past the magic number
+		br := bit.NewReaderAt(bytes.NewReader(data), off-base+48)
+		d := blockDecoder{br: br, blockSize: blockSize}
+		out, err := d.decompress()
+		res <- blockResult{out: out, crc: d.crc, end: base + br.Offset(), err: err}
+	}()
+}
+
+// compact drops data that's already been decompressed from the buffer, once
+// it makes up over half of it
+func (r *parallelReader) compact() {
+	drop := r.pos/8 - r.base
+	if drop <= int64(len(r.buf))/2 {
+		return
+	}
+	buf := make([]byte, int64(len(r.buf))-drop, cap(r.buf))
+	copy(buf, r.buf[drop:])
+	r.buf = buf
+	r.base += drop
+}
@@ -0,0 +1,422 @@
+package bzip2
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	bit "github.com/fwip/bzip2w/bit"
+	huffman "github.com/fwip/bzip2w/huffman"
+)
+
+// A StructuralError is returned when the bzip2 data is syntactically invalid
+type StructuralError string
+
+func (s StructuralError) Error() string {
+	return "bzip2 data invalid: " + string(s)
+}
+
+// A ChecksumError is returned when decompressed data doesn't match the
+// checksum stored alongside it, either for a block or for the whole stream
+type ChecksumError struct {
+	Stream    bool // Whether this was the combined checksum of the stream
+	Want, Got uint32
+}
+
+func (e ChecksumError) Error() string {
+	kind := "block"
+	if e.Stream {
+		kind = "stream"
+	}
+	return fmt.Sprintf("bzip2 %s checksum mismatch: want %08x, got %08x", kind, e.Want, e.Got)
+}
+
+var errReaderClosed = errors.New("bzip2: read from closed Reader")
+
+// Reader decompresses bzip2 data
+type Reader struct {
+	br *bit.Reader
+	stream
+	out   []byte // Decompressed data that hasn't been read yet
+	err   error
+	block blockDecoder // Kept between blocks to reuse its scratch space
+}
+
+var _ io.ReadCloser = &Reader{}
+
+// stream keeps track of the stream a reader is partway through. Both readers
+// parse headers and trailers through it.
+type stream struct {
+	blockSize int // Maximum length of a block, before RLE1 decoding
+	inStream  bool
+	streams   int // Number of streams started so far
+	crc       uint32
+}
+
+// startStream checks the 32 bits that start a stream, "BZh" followed by the
+// block size as a digit, and starts a new stream
+func (s *stream) startStream(header uint32) error {
+	if header>>16 != bzip2FileMagic {
+		return StructuralError("bad magic value")
+	}
+	if h, level := byte(header>>8), byte(header); h != 'h' || level < '1' || level > '9' {
+		return StructuralError("invalid compression level")
+	}
+	s.blockSize = int(byte(header)-'0') * 1e5
+	s.inStream = true
+	s.streams++
+	s.crc = 0
+	return nil
+}
+
+// endStream checks the combined checksum from the trailer that ends a stream
+func (s *stream) endStream(want uint32) error {
+	if want != s.crc {
+		return ChecksumError{Stream: true, Want: want, Got: s.crc}
+	}
+	s.inStream = false
+	return nil
+}
+
+// NewReader creates a new Reader that decompresses bzip2 data from r.
+// Concatenated streams are decompressed one after another.
+func NewReader(r io.Reader) io.ReadCloser {
+	return &Reader{br: bit.NewReader(r)}
+}
+
+// Read decompresses data into p
+func (r *Reader) Read(p []byte) (n int, err error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.nextBlock()
+	}
+	n = copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// Close stops any further reads. It doesn't close the underlying io.Reader.
+func (r *Reader) Close() error {
+	r.out = nil
+	if r.err == nil || r.err == io.EOF {
+		r.err = errReaderClosed
+	}
+	return nil
+}
+
+// read48 reads one of the 48-bit magic numbers
+func (r *Reader) read48() (uint64, error) {
+	hi, err := r.br.ReadBits32(24)
+	if err != nil {
+		return 0, err
+	}
+	lo, err := r.br.ReadBits32(24)
+	return uint64(hi)<<24 | uint64(lo), err
+}
+
+// nextBlock decompresses the next block into r.out, reading stream headers
+// and trailers as it comes to them
+func (r *Reader) nextBlock() error {
+	for {
+		if !r.inStream {
+			if err := r.readHeader(); err != nil {
+				return err
+			}
+		}
+
+		magic, err := r.read48()
+		if err != nil {
+			return unexpected(err)
+		}
+		switch magic {
+		case bzip2BlockMagic:
+			return r.readBlock()
+		case bzip2FinalMagic:
+			want, err := r.br.ReadBits32(32)
+			if err != nil {
+				return unexpected(err)
+			}
+			if err := r.endStream(want); err != nil {
+				return err
+			}
+			r.br.Align()
+		default:
+			return StructuralError("bad magic value")
+		}
+	}
+}
+
+// readHeader reads the "BZh" magic and block size that start a stream
+func (r *Reader) readHeader() error {
+	// Streams end on a byte boundary, so the input ends cleanly after one if
+	// there isn't a single byte left. Any less than a header is an error.
+	if r.streams > 0 {
+		if _, err := r.br.PeekBits(8); err == io.EOF {
+			return io.EOF
+		}
+	}
+	header, err := r.br.ReadBits32(32)
+	if err != nil {
+		return unexpected(err)
+	}
+	return r.startStream(header)
+}
+
+// readBlock reads a block, following its magic number, and decompresses it
+// into r.out
+func (r *Reader) readBlock() error {
+	r.block.br = r.br
+	r.block.blockSize = r.blockSize
+	out, err := r.block.decompress()
+	if err != nil {
+		return err
+	}
+	r.crc = combineCRC(r.crc, r.block.crc)
+	r.out = out
+	return nil
+}
+
+// blockDecoder decompresses a single block
+type blockDecoder struct {
+	br        *bit.Reader
+	blockSize int
+
+	crc     uint32
+	origPtr int
+
+	// Scratch space, which can be reused between blocks
+	bwtOut []byte
+	next   []uint32
+	buf    []byte
+}
+
+// decompress reads a block, following its magic number, and returns its
+// contents. They're only valid until the next call.
+func (d *blockDecoder) decompress() ([]byte, error) {
+	if err := d.decode(); err != nil {
+		return nil, err
+	}
+
+	if cap(d.next) < len(d.bwtOut) {
+		d.next = make([]uint32, len(d.bwtOut))
+	}
+	d.buf = unrle(unbwt(d.bwtOut, d.origPtr, d.next[:len(d.bwtOut)]), d.buf[:0])
+
+	if crc := updateCRC(0, d.buf); crc != d.crc {
+		return nil, ChecksumError{Want: d.crc, Got: crc}
+	}
+	return d.buf, nil
+}
+
+// decode parses the block, undoing everything up to the BWT
+func (d *blockDecoder) decode() (err error) {
+	br := d.br
+	read := func(count uint) uint32 {
+		if err != nil {
+			return 0
+		}
+		var v uint32
+		v, err = br.ReadBits32(count)
+		return v
+	}
+
+	d.crc = read(32)
+	if read(1) != 0 {
+		return StructuralError("deprecated randomised blocks aren't supported")
+	}
+	d.origPtr = int(read(24))
+
+	// Bytes used in the block, which make up the MTF alphabet
+	usedMap := read(16)
+	var seq []byte
+	for i := 0; i < 16; i++ {
+		if usedMap&(1<<uint(15-i)) == 0 {
+			continue
+		}
+		bitmap := read(16)
+		for j := 0; j < 16; j++ {
+			if bitmap&(1<<uint(15-j)) != 0 {
+				seq = append(seq, byte(i*16+j))
+			}
+		}
+	}
+	if err != nil {
+		return unexpected(err)
+	}
+	if len(seq) == 0 {
+		return StructuralError("no symbols in block")
+	}
+	alphaSize := len(seq) + 2
+	eob := alphaSize - 1
+
+	nTrees := int(read(3))
+	nSelectors := int(read(15))
+	if err != nil {
+		return unexpected(err)
+	}
+	if nTrees < 2 || nTrees > maxTrees {
+		return StructuralError("invalid number of Huffman tables")
+	}
+	if nSelectors == 0 {
+		return StructuralError("no selectors")
+	}
+	mtfd := make([]byte, nSelectors)
+	for i := range mtfd {
+		for read(1) == 1 {
+			mtfd[i]++
+			if int(mtfd[i]) >= nTrees {
+				return StructuralError("selector out of range")
+			}
+		}
+	}
+	if err != nil {
+		return unexpected(err)
+	}
+	selectors := unMoveToFront(mtfd, selectorOrder(nTrees))
+
+	trees := make([]*huffman.Decoder, nTrees)
+	for t := range trees {
+		book, err := huffman.ReadLengths(br, alphaSize)
+		if err == huffman.ErrBadLength {
+			return StructuralError("invalid Huffman code length")
+		}
+		if err != nil {
+			return unexpected(err)
+		}
+		trees[t] = huffman.NewDecoder(book)
+	}
+
+	// Undo the Huffman coding, RLE2 and MTF all at once
+	out := d.bwtOut[:0]
+	frontlist := seq
+	var count, place int = 0, 1
+	for i := 0; ; i++ {
+		if i/groupSize >= nSelectors {
+			return StructuralError("ran out of selectors")
+		}
+		sym, err := trees[selectors[i/groupSize]].Decode(br)
+		if err == huffman.ErrBadCode {
+			return StructuralError("invalid Huffman code")
+		}
+		if err != nil {
+			return unexpected(err)
+		}
+
+		switch sym {
+		case runA:
+			count += place
+		case runB:
+			count += 2 * place
+		}
+		if sym == runA || sym == runB {
+			place <<= 1
+			if count > d.blockSize {
+				return StructuralError("run too long")
+			}
+			continue
+		}
+
+		if len(out)+count > d.blockSize {
+			return StructuralError("block too long")
+		}
+		for ; count > 0; count-- {
+			out = append(out, frontlist[0])
+		}
+		place = 1
+
+		if sym == eob {
+			break
+		}
+		if len(out) == d.blockSize {
+			return StructuralError("block too long")
+		}
+		idx := sym - 1
+		c := frontlist[idx]
+		copy(frontlist[1:idx+1], frontlist[:idx])
+		frontlist[0] = c
+		out = append(out, c)
+	}
+	d.bwtOut = out
+
+	if d.origPtr >= len(out) {
+		return StructuralError("origPtr out of bounds")
+	}
+	return nil
+}
+
+// unbwt inverts bwt, starting from the row at origPtr. next needs to be as
+// long as the input, and is used as scratch space.
+func unbwt(in []byte, origPtr int, next []uint32) []byte {
+	// next[i] is the row that follows row i in the original input
+	var starts [256]int
+	for _, c := range in {
+		starts[c]++
+	}
+	sum := 0
+	for c, count := range starts {
+		starts[c] = sum
+		sum += count
+	}
+	for i, c := range in {
+		next[starts[c]] = uint32(i)
+		starts[c]++
+	}
+
+	out := make([]byte, len(in))
+	row := origPtr
+	for i := range out {
+		row = int(next[row])
+		out[i] = in[row]
+	}
+	return out
+}
+
+// unrle inverts the initial run-length encoding, appending to out
+func unrle(in []byte, out []byte) []byte {
+	expandRuns(in, func(literal []byte) {
+		out = append(out, literal...)
+	}, func(c byte, n int) {
+		for ; n > 0; n-- {
+			out = append(out, c)
+		}
+	})
+	return out
+}
+
+// expandRuns walks through the initial run-length encoding in order, passing
+// each stretch of bytes that stand for themselves to literal, and each run
+// that a count byte stands for to repeat, as n more copies of c. Both the
+// decoder and the encoder's checksum go through here, so that they agree.
+func expandRuns(in []byte, literal func([]byte), repeat func(c byte, n int)) {
+	var run int
+	var last byte
+	start := 0
+	for i := 0; i < len(in); i++ {
+		c := in[i]
+		if run > 0 && c == last {
+			run++
+		} else {
+			run = 1
+			last = c
+		}
+		// Four in a row are followed by a count of additional repeats
+		if run == 4 && i+1 < len(in) {
+			literal(in[start : i+1])
+			i++
+			repeat(c, int(in[i]))
+			start = i + 1
+			run = 0
+		}
+	}
+	literal(in[start:])
+}
+
+// unexpected turns an EOF partway through a stream into io.ErrUnexpectedEOF
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,254 @@
+package bzip2
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// "hello world\n", compressed by the reference bzip2
+var helloWorld = []byte{
+	0x42, 0x5a, 0x68, 0x39, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59, 0x4e, 0xec,
+	0xe8, 0x36, 0x00, 0x00, 0x02, 0x51, 0x80, 0x00, 0x10, 0x40, 0x00, 0x06,
+	0x44, 0x90, 0x80, 0x20, 0x00, 0x31, 0x06, 0x4c, 0x41, 0x01, 0xa7, 0xa9,
+	0xa5, 0x80, 0xbb, 0x94, 0x31, 0xf8, 0xbb, 0x92, 0x29, 0xc2, 0x84, 0x82,
+	0x77, 0x67, 0x41, 0xb0,
+}
+
+func compress(t *testing.T, input []byte) []byte {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Write(input)
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestReader(t *testing.T) {
+	output, err := ioutil.ReadAll(NewReader(bytes.NewReader(helloWorld)))
+	if err != nil || string(output) != "hello world\n" {
+		t.Errorf("Reader: expected %q, got %q, %v", "hello world\n", output, err)
+	}
+
+	random := make([]byte, 20000)
+	for i := range random {
+		random[i] = byte(rand.Intn(16))
+	}
+	inputs := []string{
+		"",
+		"a",
+		"banana",
+		"AAAAAAABBBBCCCDEE",
+		strings.Repeat("ab", 1000),
+		strings.Repeat("hello world, ", 500),
+		string(random),
+	}
+	for _, input := range inputs {
+		output, err := ioutil.ReadAll(NewReader(bytes.NewReader(compress(t, []byte(input)))))
+		if err != nil {
+			t.Errorf("Reader: Gave %.20q..., got error %v", input, err)
+			continue
+		}
+		if string(output) != input {
+			t.Errorf("Reader: Gave %.20q..., got back %.20q...", input, output)
+		}
+	}
+}
+
+func TestReaderConcatenated(t *testing.T) {
+	stream := append(compress(t, []byte("banana")), helloWorld...)
+	output, err := ioutil.ReadAll(NewReader(bytes.NewReader(stream)))
+	if err != nil || string(output) != "bananahello world\n" {
+		t.Errorf("Reader: expected %q, got %q, %v", "bananahello world\n", output, err)
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	corrupt := func(i int, x byte) []byte {
+		b := append([]byte{}, helloWorld...)
+		b[i] ^= x
+		return b
+	}
+
+	tests := []struct {
+		input []byte
+		check func(error) bool
+	}{
+		{[]byte{}, func(err error) bool { return err == io.ErrUnexpectedEOF }},
+		{helloWorld[:30], func(err error) bool { return err == io.ErrUnexpectedEOF }},
+		{[]byte("BZh0"), func(err error) bool { _, ok := err.(StructuralError); return ok }},
+		{corrupt(0, 1), func(err error) bool { _, ok := err.(StructuralError); return ok }},
+		{corrupt(4, 1), func(err error) bool { _, ok := err.(StructuralError); return ok }},
+		// Block checksum
+		{corrupt(10, 1), func(err error) bool { e, ok := err.(ChecksumError); return ok && !e.Stream }},
+		// Stream checksum
+		{corrupt(len(helloWorld)-2, 1), func(err error) bool { e, ok := err.(ChecksumError); return ok && e.Stream }},
+		// Less than a stream header after a complete stream
+		{append(append([]byte{}, helloWorld...), 0x42), func(err error) bool { return err == io.ErrUnexpectedEOF }},
+		{append(append([]byte{}, helloWorld...), "BZh"...), func(err error) bool { return err == io.ErrUnexpectedEOF }},
+	}
+	for i, test := range tests {
+		_, err := ioutil.ReadAll(NewReader(bytes.NewReader(test.input)))
+		if !test.check(err) {
+			t.Errorf("Reader: test %d, got unexpected error %v", i, err)
+		}
+		_, err = ioutil.ReadAll(NewParallelReader(bytes.NewReader(test.input), 2))
+		if !test.check(err) {
+			t.Errorf("ParallelReader: test %d, got unexpected error %v", i, err)
+		}
+	}
+}
+
+func TestReaderClose(t *testing.T) {
+	r := NewReader(bytes.NewReader(helloWorld))
+	if err := r.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	if _, err := r.Read(make([]byte, 10)); err == nil {
+		t.Errorf("Read: expected an error after Close")
+	}
+}
+
+func TestParallelReader(t *testing.T) {
+	var stream []byte
+	var expected string
+	for i := 0; i < 20; i++ {
+		input := strings.Repeat(string('a'+byte(i)), i) + "banana"
+		stream = append(stream, compress(t, []byte(input))...)
+		stream = append(stream, helloWorld...)
+		expected += input + "hello world\n"
+	}
+
+	for _, workers := range []int{0, 1, 3} {
+		output, err := ioutil.ReadAll(NewParallelReader(bytes.NewReader(stream), workers))
+		if err != nil || string(output) != expected {
+			t.Errorf("ParallelReader(%d): expected %.20q..., got %.20q..., %v", workers, expected, output, err)
+		}
+	}
+
+	// Errors should match the sequential Reader's
+	corrupt := append([]byte{}, helloWorld...)
+	corrupt[10] ^= 1
+	_, err := ioutil.ReadAll(NewParallelReader(bytes.NewReader(corrupt), 2))
+	if e, ok := err.(ChecksumError); !ok || e.Stream {
+		t.Errorf("ParallelReader: expected a block ChecksumError, got %v", err)
+	}
+	_, err = ioutil.ReadAll(NewParallelReader(bytes.NewReader(helloWorld[:30]), 2))
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("ParallelReader: expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestParallelReaderBlocks(t *testing.T) {
+	// Enough 100k blocks that lookahead has to stop at 2*workers, and resume
+	// from where it left off
+	r := rand.New(rand.NewSource(1))
+	var input []byte
+	for len(input) < 1200000 {
+		word := []byte(strings.Repeat(string('a'+byte(r.Intn(26))), 1+r.Intn(8)))
+		input = append(input, word...)
+		input = append(input, byte(r.Intn(256)))
+	}
+	var buf bytes.Buffer
+	w, _ := NewWriterLevel(&buf, 1)
+	w.Write(input)
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	stream := buf.Bytes()
+
+	expected, err := ioutil.ReadAll(NewReader(bytes.NewReader(stream)))
+	if err != nil || !bytes.Equal(expected, input) {
+		t.Fatalf("Reader: couldn't read back the input: %v", err)
+	}
+	for _, workers := range []int{2, 4} {
+		output, err := ioutil.ReadAll(NewParallelReader(bytes.NewReader(stream), workers))
+		if err != nil || !bytes.Equal(output, expected) {
+			t.Errorf("ParallelReader(%d): output doesn't match Reader's, %v", workers, err)
+		}
+	}
+
+	// Block magic numbers that turn up inside a block are decompressed from
+	// too, but never used. Start from a few such offsets, as if they'd been
+	// found by chance.
+	pr := NewParallelReader(bytes.NewReader(stream), 2).(*parallelReader)
+	if err := pr.readHeader(); err != nil {
+		t.Fatalf("readHeader: %v", err)
+	}
+	if err := pr.fill(int64(maxBlockBytes(pr.blockSize))); err != nil {
+		t.Fatalf("fill: %v", err)
+	}
+	var spurious []chan blockResult
+	for _, off := range []int64{pr.pos + 100, pr.pos + 1001, pr.pos + 5003} {
+		pr.start(off)
+		spurious = append(spurious, pr.pending[blockKey{off, pr.blockSize}])
+	}
+	output, err := ioutil.ReadAll(pr)
+	if err != nil || !bytes.Equal(output, expected) {
+		t.Errorf("ParallelReader: spurious blocks changed the output, %v", err)
+	}
+	for _, res := range spurious {
+		if res := <-res; res.err == nil {
+			t.Errorf("ParallelReader: a spurious block decompressed without error, to %d bytes", len(res.out))
+		}
+	}
+}
+
+func TestParallelReaderStreams(t *testing.T) {
+	// One block per stream, as Flush or pbzip2 write them
+	r := rand.New(rand.NewSource(2))
+	var parts [][]byte
+	for i := 0; i < 20; i++ {
+		var part []byte
+		for len(part) < 95000 {
+			word := []byte(strings.Repeat(string('a'+byte(r.Intn(26))), 1+r.Intn(8)))
+			part = append(part, word...)
+			part = append(part, byte(r.Intn(256)))
+		}
+		parts = append(parts, part)
+	}
+	streams := func(levels func(i int) int) (stream, input []byte) {
+		var buf bytes.Buffer
+		for i, part := range parts {
+			w, _ := NewWriterLevel(&buf, levels(i))
+			w.Write(part)
+			if err := w.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+			input = append(input, part...)
+		}
+		return buf.Bytes(), input
+	}
+
+	tests := []struct {
+		levels func(i int) int
+		wasted int // Blocks thrown away for each worker
+	}{
+		// Blocks found in later streams are only decompressed once
+		{func(int) int { return 1 }, 0},
+		// Changing block size throws away up to 2*workers blocks each time
+		{func(i int) int {
+			if i == 10 {
+				return 9
+			}
+			return 1
+		}, 4},
+	}
+	for i, test := range tests {
+		stream, input := streams(test.levels)
+		for _, workers := range []int{1, 4} {
+			pr := NewParallelReader(bytes.NewReader(stream), workers).(*parallelReader)
+			output, err := ioutil.ReadAll(pr)
+			if err != nil || !bytes.Equal(output, input) {
+				t.Errorf("ParallelReader(%d): test %d, output doesn't match the input, %v", workers, i, err)
+			}
+			if pr.started < len(parts) || pr.started > len(parts)+test.wasted*workers {
+				t.Errorf("ParallelReader(%d): test %d, decompressed %d blocks from %d streams", workers, i, pr.started, len(parts))
+			}
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package bzip2
+
+import "sort"
+
+// Below this length, suffixes are just sorted directly
+const saNaiveThreshold = 10
+
+// saScratch hands out the memory that suffixArray works in, so that it can be
+// reused from one block to the next. Memory is handed out in order, and
+// everything is handed back at once by reset. A nil *saScratch allocates
+// everything afresh.
+type saScratch struct {
+	ints  []int32
+	bools []bool
+	// How much has been asked for since the last reset, which can be more
+	// than there's room for
+	usedInts, usedBools int
+}
+
+// reset hands back everything, and makes sure there'll be room for as much as
+// was asked for last time
+func (sc *saScratch) reset() {
+	if sc.usedInts > len(sc.ints) {
+		sc.ints = make([]int32, sc.usedInts)
+	}
+	if sc.usedBools > len(sc.bools) {
+		sc.bools = make([]bool, sc.usedBools)
+	}
+	sc.usedInts, sc.usedBools = 0, 0
+}
+
+// int32s returns n zeroed int32s
+func (sc *saScratch) int32s(n int) []int32 {
+	if sc == nil {
+		return make([]int32, n)
+	}
+	sc.usedInts += n
+	if sc.usedInts > len(sc.ints) {
+		return make([]int32, n)
+	}
+	ints := sc.ints[sc.usedInts-n : sc.usedInts : sc.usedInts]
+	for i := range ints {
+		ints[i] = 0
+	}
+	return ints
+}
+
+// boolSlice returns n bools, all false
+func (sc *saScratch) boolSlice(n int) []bool {
+	if sc == nil {
+		return make([]bool, n)
+	}
+	sc.usedBools += n
+	if sc.usedBools > len(sc.bools) {
+		return make([]bool, n)
+	}
+	bools := sc.bools[sc.usedBools-n : sc.usedBools : sc.usedBools]
+	for i := range bools {
+		bools[i] = false
+	}
+	return bools
+}
+
+// suffixArray returns the suffix array of s, whose values must all be in
+// [0, upper]. It uses SA-IS (Nong, Zhang & Chan, 2009), which runs in linear
+// time, even on the highly repetitive inputs that break comparison sorts.
+//
+// Memory comes from scratch, so the result is only valid until scratch is
+// reset.
+func suffixArray(s []int32, upper int32, scratch *saScratch) []int32 {
+	n := len(s)
+	switch {
+	case n == 0:
+		return nil
+	case n < saNaiveThreshold:
+		return suffixArrayNaive(s)
+	}
+
+	sa := scratch.int32s(n)
+
+	// ls[i] is true if suffix i is S-type (smaller than suffix i+1)
+	ls := scratch.boolSlice(n)
+	for i := n - 2; i >= 0; i-- {
+		if s[i] == s[i+1] {
+			ls[i] = ls[i+1]
+		} else {
+			ls[i] = s[i] < s[i+1]
+		}
+	}
+
+	// Bucket boundaries: sumL[c] is the start of the L-type suffixes
+	// beginning with c, and sumS[c] is the start of the S-type ones
+	sumL := scratch.int32s(int(upper) + 2)
+	sumS := scratch.int32s(int(upper) + 2)
+	for i := 0; i < n; i++ {
+		if !ls[i] {
+			sumS[s[i]]++
+		} else {
+			sumL[s[i]+1]++
+		}
+	}
+	for i := int32(0); i <= upper; i++ {
+		sumS[i] += sumL[i]
+		if i < upper {
+			sumL[i+1] += sumS[i]
+		}
+	}
+
+	buf := scratch.int32s(int(upper) + 2)
+	induce := func(lms []int32) {
+		for i := range sa {
+			sa[i] = -1
+		}
+		copy(buf, sumS)
+		for _, d := range lms {
+			if int(d) == n {
+				continue
+			}
+			sa[buf[s[d]]] = d
+			buf[s[d]]++
+		}
+		copy(buf, sumL)
+		sa[buf[s[n-1]]] = int32(n - 1)
+		buf[s[n-1]]++
+		for i := 0; i < n; i++ {
+			v := sa[i]
+			if v >= 1 && !ls[v-1] {
+				sa[buf[s[v-1]]] = v - 1
+				buf[s[v-1]]++
+			}
+		}
+		copy(buf, sumL)
+		for i := n - 1; i >= 0; i-- {
+			v := sa[i]
+			if v >= 1 && ls[v-1] {
+				buf[s[v-1]+1]--
+				sa[buf[s[v-1]+1]] = v - 1
+			}
+		}
+	}
+
+	// Find the leftmost-S-type (LMS) positions
+	lmsMap := scratch.int32s(n + 1)
+	m := 0
+	for i := range lmsMap {
+		lmsMap[i] = -1
+		if i > 0 && i < n && !ls[i-1] && ls[i] {
+			m++
+		}
+	}
+	lms := scratch.int32s(m)[:0]
+	for i := 1; i < n; i++ {
+		if !ls[i-1] && ls[i] {
+			lmsMap[i] = int32(len(lms))
+			lms = append(lms, int32(i))
+		}
+	}
+
+	induce(lms)
+
+	if m == 0 {
+		return sa
+	}
+
+	// Name the LMS substrings, and recursively sort them if they aren't unique
+	sortedLMS := scratch.int32s(m)[:0]
+	for _, v := range sa {
+		if lmsMap[v] != -1 {
+			sortedLMS = append(sortedLMS, v)
+		}
+	}
+	recS := scratch.int32s(m)
+	var recUpper int32
+	recS[lmsMap[sortedLMS[0]]] = 0
+	for i := 1; i < m; i++ {
+		l, r := int(sortedLMS[i-1]), int(sortedLMS[i])
+		endL, endR := n, n
+		if next := lmsMap[l] + 1; int(next) < m {
+			endL = int(lms[next])
+		}
+		if next := lmsMap[r] + 1; int(next) < m {
+			endR = int(lms[next])
+		}
+		same := true
+		if endL-l != endR-r {
+			same = false
+		} else {
+			for l < endL && s[l] == s[r] {
+				l++
+				r++
+			}
+			if l == n || s[l] != s[r] {
+				same = false
+			}
+		}
+		if !same {
+			recUpper++
+		}
+		recS[lmsMap[sortedLMS[i]]] = recUpper
+	}
+
+	recSA := suffixArray(recS, recUpper, scratch)
+	for i := range sortedLMS {
+		sortedLMS[i] = lms[recSA[i]]
+	}
+	induce(sortedLMS)
+
+	return sa
+}
+
+// suffixArrayNaive sorts the suffixes of s by comparing them directly
+func suffixArrayNaive(s []int32) []int32 {
+	sa := make([]int32, len(s))
+	for i := range sa {
+		sa[i] = int32(i)
+	}
+	sort.Slice(sa, func(a, b int) bool {
+		l, r := s[sa[a]:], s[sa[b]:]
+		for i := 0; i < len(l) && i < len(r); i++ {
+			if l[i] != r[i] {
+				return l[i] < r[i]
+			}
+		}
+		return len(l) < len(r)
+	})
+	return sa
+}
@@ -0,0 +1,180 @@
+package bzip2
+
+import (
+	bit "github.com/fwip/bzip2w/bit"
+	huffman "github.com/fwip/bzip2w/huffman"
+)
+
+const (
+	minTrees     = 2 // The format needs at least two Huffman tables
+	maxTrees     = 6 // and allows at most six
+	huffmanIters = 4 // Passes spent refining the tables, as the reference encoder does
+
+	// Costs used to seed the initial tables
+	lesserCost  = 0
+	greaterCost = 15
+)
+
+// numTrees picks how many Huffman tables to use for a block with n symbols.
+// More tables fit the data better, but each costs space in the header.
+func numTrees(n int) int {
+	switch {
+	case n < 200:
+		return 2
+	case n < 600:
+		return 3
+	case n < 1200:
+		return 4
+	case n < 2400:
+		return 5
+	}
+	return maxTrees
+}
+
+// tableParams controls how chooseTrees builds the Huffman tables
+type tableParams struct {
+	nTrees int // Number of tables to use, or 0 to pick one with numTrees
+	iters  int // Number of refinement passes
+}
+
+var defaultTableParams = tableParams{iters: huffmanIters}
+
+// tableScratch holds chooseTrees' working space and results, so that they can
+// be reused from one block to the next
+type tableScratch struct {
+	lengths   [maxTrees][]byte
+	treeFreq  [maxTrees][]int
+	trees     []huffman.Book
+	selectors []byte
+	builder   huffman.Builder
+}
+
+// chooseTrees builds a set of Huffman tables for the symbols, and picks which
+// table to use for each group of groupSize symbols. freq holds the number of
+// times each symbol occurs, and its length is the size of the alphabet.
+//
+// The tables start out covering slices of the alphabet with roughly equal
+// total frequency. Each pass then assigns every group to the table that codes
+// it most cheaply, and rebuilds each table from the groups assigned to it.
+//
+// The tables and selectors returned live in scratch, which can be nil.
+func chooseTrees(symbols []uint16, freq []int, params tableParams, scratch *tableScratch) (trees []huffman.Book, selectors []byte) {
+	if scratch == nil {
+		scratch = &tableScratch{}
+	}
+	alphaSize := len(freq)
+	nTrees := params.nTrees
+	if nTrees == 0 {
+		nTrees = numTrees(len(symbols))
+	}
+	nSelectors := (len(symbols) + groupSize - 1) / groupSize
+	if cap(scratch.selectors) < nSelectors {
+		scratch.selectors = make([]byte, nSelectors)
+	}
+	selectors = scratch.selectors[:nSelectors]
+
+	// lengths[t][s] is the cost of coding symbol s with table t, and
+	// treeFreq[t][s] is how often symbol s is coded with table t
+	lengths := scratch.lengths[:nTrees]
+	treeFreq := scratch.treeFreq[:nTrees]
+	for t := range lengths {
+		if cap(lengths[t]) < alphaSize {
+			lengths[t] = make([]byte, alphaSize)
+			treeFreq[t] = make([]int, alphaSize)
+		}
+		lengths[t] = lengths[t][:alphaSize]
+		treeFreq[t] = treeFreq[t][:alphaSize]
+	}
+
+	// Seed each table with a contiguous range of the alphabet
+	remaining := len(symbols)
+	start := 0
+	for part := nTrees; part > 0; part-- {
+		target := remaining / part
+		end := start - 1
+		sum := 0
+		for sum < target && end < alphaSize-1 {
+			end++
+			sum += freq[end]
+		}
+		// Alternate which side of the boundary the last symbol falls on
+		if end > start && part != nTrees && part != 1 && (nTrees-part)%2 == 1 {
+			sum -= freq[end]
+			end--
+		}
+		for s := range lengths[part-1] {
+			if s >= start && s <= end {
+				lengths[part-1][s] = lesserCost
+			} else {
+				lengths[part-1][s] = greaterCost
+			}
+		}
+		start = end + 1
+		remaining -= sum
+	}
+
+	if cap(scratch.trees) < nTrees {
+		scratch.trees = make([]huffman.Book, maxTrees)
+	}
+	trees = scratch.trees[:nTrees]
+	for iter := 0; iter < params.iters; iter++ {
+		for t := range treeFreq {
+			for s := range treeFreq[t] {
+				treeFreq[t][s] = 0
+			}
+		}
+
+		// Assign each group to its cheapest table
+		for g := range selectors {
+			group := symbols[g*groupSize:]
+			if len(group) > groupSize {
+				group = group[:groupSize]
+			}
+			best, bestCost := 0, -1
+			for t := range lengths {
+				cost := 0
+				for _, s := range group {
+					cost += int(lengths[t][s])
+				}
+				if bestCost < 0 || cost < bestCost {
+					best, bestCost = t, cost
+				}
+			}
+			selectors[g] = byte(best)
+			for _, s := range group {
+				treeFreq[best][s]++
+			}
+		}
+
+		// Rebuild the tables to fit the groups they were assigned
+		for t := range trees {
+			trees[t] = scratch.builder.Rebuild(trees[t], treeFreq[t])
+			for s, c := range trees[t].Codes {
+				lengths[t][s] = byte(c.Len())
+			}
+		}
+	}
+
+	return trees, selectors
+}
+
+// selectorOrder is the initial move-to-front list for nTrees selectors
+func selectorOrder(nTrees int) []byte {
+	order := make([]byte, nTrees)
+	for i := range order {
+		order[i] = byte(i)
+	}
+	return order
+}
+
+// writeSelectors writes the number of selectors, then each one move-to-front
+// transformed and written in unary: n ones followed by a zero.
+func writeSelectors(w *bit.Writer, selectors []byte, nTrees int) {
+	w.WriteBits32(uint32(len(selectors)), 15)
+	for _, idx := range moveToFront(selectors, selectorOrder(nTrees), nil) {
+		for ; idx > 0; idx-- {
+			w.WriteBit(1)
+		}
+		w.WriteBit(0)
+	}
+}
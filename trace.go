@@ -0,0 +1,43 @@
+package bzip2
+
+import "time"
+
+// A Tracer is told about each block as it goes through a Writer, and about
+// calls to Flush and Close. Blocks are encoded in parallel, so its methods can
+// be called from several goroutines at once. They're called in the middle of
+// compressing, so they should return quickly.
+type Tracer interface {
+	// BlockStarted is called when a block is full, and starts being encoded
+	BlockStarted(b BlockInfo)
+	// BlockEncoded is called once a block has been encoded. Blocks can finish
+	// encoding out of order.
+	BlockEncoded(b BlockInfo)
+	// BlockWritten is called once a block has been written out, in order
+	BlockWritten(b BlockInfo)
+	// Flushed is called as each call to Flush returns, once it has pushed out
+	// everything before it or failed to, with the error Flush returns
+	Flushed(err error)
+	// Closed is called as each call to Close returns, including calls after
+	// the first, with the error Close returns
+	Closed(err error)
+}
+
+// BlockInfo describes a block. Fields are filled in as the block goes through
+// the Writer, so they're only set in the calls to a Tracer noted beside them.
+type BlockInfo struct {
+	Index   int // Number of blocks that came before this one
+	RawSize int // Bytes of input in the block
+	RLESize int // Bytes left after the initial run-length encoding
+
+	EncodeTime time.Duration // Time spent encoding the block; from BlockEncoded on
+	Bits       int64         // Size of the compressed block in bits; in BlockWritten
+}
+
+// nopTracer is the Tracer used when none is given
+type nopTracer struct{}
+
+func (nopTracer) BlockStarted(BlockInfo) {}
+func (nopTracer) BlockEncoded(BlockInfo) {}
+func (nopTracer) BlockWritten(BlockInfo) {}
+func (nopTracer) Flushed(error)          {}
+func (nopTracer) Closed(error)           {}
@@ -2,8 +2,10 @@ package bzip2
 
 import (
 	"errors"
-	"fmt"
 	"io"
+	"runtime"
+	"sync"
+	"time"
 )
 import bit "github.com/fwip/bzip2w/bit"
 
@@ -19,141 +21,416 @@ const (
 )
 
 // Writer implememnts io.WriteCloser
+//
+// Blocks are compressed in parallel, by up to SetConcurrency of them at once,
+// and no more blocks than that are held in memory waiting to be written. One
+// more block is being filled, and since blocks are recycled, it can still be
+// holding the scratch space from an earlier one. Encoding takes about 72 bytes
+// of memory per byte of a block, so a Writer uses at most roughly
+//
+//	(concurrency + 1) * blockSize * 100000 * 72 bytes
+//
+// which is about 130MB with one worker and 900k blocks. Blocks and their
+// scratch space are kept after Close, so that Reset can reuse them; that
+// memory is only freed once the Writer itself is dropped. Use a smaller block
+// size or fewer workers when running many Writers at once.
 type Writer struct {
 	w             *bit.Writer
 	blockSize     byte // 1 - 9
+	concurrency   int  // Maximum number of blocks in flight
+	tables        tableParams
+	tracer        Tracer
+	pool          *blockPool
 	headerWritten bool
-	sendTo        chan []byte
-	blocks        []blockEncoder
-	currentBlock  int
+	sendTo        chan chunk
 	closed        chan struct{}
+	isClosed      bool
+
+	// The first error from the pipeline, which is returned from then on
+	mu    sync.Mutex
+	err   error
+	abort chan struct{} // Closed on error, to shut the pipeline down
 }
 
 var _ io.Writer = &Writer{}
 
+var (
+	errWriterClosed = errors.New("bzip2: write to closed Writer")
+	errWriterReset  = errors.New("bzip2: Writer was reset")
+)
+
+// chunk is a piece of data travelling down the pipeline. consumed is closed
+// once the chunker is done reading data, so the caller can reuse it. If flush
+// is set, everything ahead of it is pushed out of the pipeline, and flush is
+// closed once that's been written.
+type chunk struct {
+	data     []byte
+	consumed chan struct{}
+	flush    chan struct{}
+}
+
 // NewWriter creates a new Wrtier that bzip2 compresses the input
 func NewWriter(w io.Writer) *Writer {
 	writer := Writer{
-		w:         bit.NewWriter(w),
-		blockSize: 9,
+		w:           bit.NewWriter(w),
+		blockSize:   9,
+		concurrency: runtime.GOMAXPROCS(0),
+		tables:      defaultTableParams,
+		tracer:      nopTracer{},
 	}
 
-	writer.setUp()
-
 	return &writer
 }
 
+// NewWriterLevel is like NewWriter, but uses the given block size (1-9)
+// instead of the default of 9.
+func NewWriterLevel(w io.Writer, level int) (*Writer, error) {
+	return NewWriterOptions(w, BlockSize(level))
+}
+
 // Write compresses bytes with bzip2 and then sends them to the underlying io.Writer
+// If compressing or writing out earlier data failed, that error is returned.
 func (w *Writer) Write(b []byte) (n int, err error) {
+	if w.isClosed {
+		return 0, errWriterClosed
+	}
+	if !w.headerWritten {
+		w.setUp()
+	}
+	if err := w.getErr(); err != nil {
+		return 0, err
+	}
 
-	w.sendTo <- b
-	return len(b), nil
-	// Allocate a new blockEncoder if we need to
-	if w.currentBlock == len(w.blocks) {
-		blockSize := 1e5 * uint(w.blockSize)
-		w.blocks = append(w.blocks, *newBlockEncoder(blockSize))
+	if len(b) == 0 {
+		return 0, nil
 	}
 
-	n, _ = w.blocks[w.currentBlock].Write(b)
+	// Wait for the chunker to finish with b, rather than copying it. Once it
+	// has the chunk, it always closes consumed, even if the pipeline aborts.
+	consumed := make(chan struct{})
+	select {
+	case w.sendTo <- chunk{data: b, consumed: consumed}:
+	case <-w.abort:
+		return 0, w.getErr()
+	}
+	<-consumed
+	if err := w.getErr(); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Flush writes out everything written so far, so that it can be decompressed
+// without waiting for more input. The current block is cut short, and the
+// stream is ended; writing more starts a new stream, which decoders read as a
+// continuation of the first. Flushing often hurts compression.
+func (w *Writer) Flush() error {
+	err := w.flush()
+	w.tracer.Flushed(err)
+	return err
+}
 
-	// If encoder is full, Write again with the leftovers
-	if n < len(b) {
-		w.currentBlock++
-		n2, err := w.Write(b[n:])
-		return n + n2, err
+func (w *Writer) flush() error {
+	if w.isClosed {
+		return errWriterClosed
+	}
+	if !w.headerWritten {
+		w.setUp()
+	}
+	if err := w.getErr(); err != nil {
+		return err
 	}
 
-	return n, nil
+	flushed := make(chan struct{})
+	select {
+	case w.sendTo <- chunk{flush: flushed}:
+	case <-w.abort:
+		return w.getErr()
+	}
+	select {
+	case <-flushed:
+	case <-w.abort:
+	}
+	return w.getErr()
 }
 
+// setUp starts the pipeline, which writes the header. Settings can't be
+// changed after this.
 func (w *Writer) setUp() {
+	w.headerWritten = true
 	w.closed = make(chan struct{})
+	w.abort = make(chan struct{})
+	w.sendTo = make(chan chunk)
+	outputChan := make(chan *blockEncoder, w.concurrency)
+	// Blocks, and their scratch space, are kept across calls to Reset
 	size := int(w.blockSize) * 1e5
-	w.sendTo = make(chan []byte)
-	postRLE := make(chan []byte)
-	go rlePipeline(w.sendTo, postRLE)
-	outputChan := make(chan *blockEncoder)
-	go chunker(size, postRLE, outputChan)
-	go writePipeline(outputChan, w.w, w.closed)
+	if w.pool == nil || w.pool.size != size || cap(w.pool.inFlight) != w.concurrency {
+		w.pool = newBlockPool(size, w.concurrency)
+	}
+	go chunker(w.pool, w.tables, w.tracer, w.sendTo, outputChan, w.abort)
+	go writePipeline(w.blockSize, outputChan, w.pool, w.tracer, w.w, w.closed, w.abort, w.setErr)
 }
 
-// TODO: This probably holds onto all the memory and prevents GC
-func rlePipeline(input <-chan []byte, output chan<- []byte) {
-	var prev []byte
-	for in := range input {
-		fmt.Println("RLEing", in)
-		send, leftovers := rle(append(prev, in...))
-		output <- send
-		prev = leftovers
+// setErr records the first error from the pipeline, and shuts it down
+func (w *Writer) setErr(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = err
+		close(w.abort)
 	}
-	output <- prev
-	close(output)
+}
 
+func (w *Writer) getErr() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
 }
 
-func chunker(size int, input <-chan []byte, results chan *blockEncoder) {
-	cache := make([]byte, 0, size)
-	for in := range input {
-		if len(in) == 0 {
-			continue
+// blockPool bounds the number of blocks being encoded or waiting to be
+// written, and recycles them once they've been written, along with their
+// buffers and scratch space
+type blockPool struct {
+	size     int // Capacity of each block's input buffer
+	inFlight chan struct{}
+	free     chan *blockEncoder
+}
+
+func newBlockPool(size, n int) *blockPool {
+	return &blockPool{
+		size:     size,
+		inFlight: make(chan struct{}, n),
+		free:     make(chan *blockEncoder, n+1), // One more, for the block being filled
+	}
+}
+
+// get returns an empty block, reusing an old one if it can
+func (p *blockPool) get() *blockEncoder {
+	select {
+	case block := <-p.free:
+		block.input = block.input[:0]
+		return block
+	default:
+		return &blockEncoder{input: make([]byte, 0, p.size)}
+	}
+}
+
+// put keeps a block that isn't in flight to be reused
+func (p *blockPool) put(block *blockEncoder) {
+	select {
+	case p.free <- block:
+	default:
+	}
+}
+
+// acquire waits until there's room for another block in flight. It gives up
+// if abort is closed first.
+func (p *blockPool) acquire(abort <-chan struct{}) bool {
+	select {
+	case p.inFlight <- struct{}{}:
+		return true
+	case <-abort:
+		return false
+	}
+}
+
+// release makes room for another block, once one has been written, and keeps
+// it to be reused
+func (p *blockPool) release(block *blockEncoder) {
+	p.put(block)
+	<-p.inFlight
+}
+
+// chunker run-length encodes the input, splits it into blocks, and starts
+// encoding each one. Like the reference encoder, it leaves blocks 19 bytes
+// short of the block size after RLE1, and never splits a run between two
+// blocks. Each block comes from pool, and waits for room to be in flight.
+//
+// writePipeline takes everything sent to it, even after an error, so sending
+// never blocks for long. Once abort is closed, chunker stops reading input and
+// returns, which lets writePipeline finish too.
+func chunker(pool *blockPool, params tableParams, tracer Tracer, input <-chan chunk, results chan<- *blockEncoder, abort <-chan struct{}) {
+	defer close(results)
+
+	limit := pool.size - 19
+	var enc rleEncoder
+	var index int
+	block := pool.get()
+	// send starts encoding the block being filled, if there's anything in it
+	send := func() bool {
+		if len(block.input) == 0 {
+			return true
 		}
-		fmt.Println("Chunking...")
-		room := cap(cache) - len(cache)
-		length := len(in)
+		if !pool.acquire(abort) {
+			pool.put(block)
+			return false
+		}
+		block.params = params
+		block.info = BlockInfo{Index: index, RawSize: enc.cut(), RLESize: len(block.input)}
+		index++
+		tracer.BlockStarted(block.info)
+		results <- encodeAsync(block, tracer)
+		block = pool.get()
+		return true
+	}
 
-		if length > room {
-			cache = append(cache, in[:room]...)
-			block := encodeAsync(cache)
-			results <- block
-			cache = cache[:0]
-			copy(cache, in[room:])
+	for {
+		var c chunk
+		var ok bool
+		select {
+		case c, ok = <-input:
+		case <-abort:
+			pool.put(block)
+			return
+		}
+		if !ok {
+			break
+		}
 
-		} else {
-			cache = append(cache, in...)
+		if c.flush != nil {
+			// Cut the current block short, and pass the flush along behind it
+			block.input = enc.flush(block.input)
+			if !send() {
+				return
+			}
+			results <- &blockEncoder{flush: c.flush}
+			continue
+		}
+		for in := c.data; len(in) > 0; {
+			var n int
+			block.input, n = enc.encode(block.input, in, limit)
+			in = in[n:]
+			if len(block.input) >= limit && !send() {
+				close(c.consumed)
+				return
+			}
 		}
+		close(c.consumed)
+	}
+	// bzip2 never writes empty blocks
+	block.input = enc.flush(block.input)
+	if send() {
+		pool.put(block)
 	}
-	block := encodeAsync(cache)
-	results <- block
-	close(results)
 }
 
 // Returns a locked blockEncoder that asynchronously encodes
 // Will unlock once it's finished.
-func encodeAsync(in []byte) *blockEncoder {
-	fmt.Println("Async encoding", in)
-	b := blockEncoder{}
-	b.input = in
-
+func encodeAsync(b *blockEncoder, tracer Tracer) *blockEncoder {
 	b.Add(1)
 	go func() {
+		start := time.Now()
 		b.encode()
+		b.info.EncodeTime = time.Since(start)
+		tracer.BlockEncoded(b.info)
 		b.Done()
 	}()
-	return &b
+	return b
 }
 
-func writePipeline(blocks chan *blockEncoder, w *bit.Writer, done chan struct{}) {
+// writePipeline writes out the stream as blocks finish encoding. The bit.Writer
+// keeps hold of the first error it runs into, so writing can be checked once
+// per block; on error, fail is called, which closes abort.
+//
+// A flush ends the stream, and the next block starts a new one. Each block is
+// released back to pool once it's been written. Once abort is closed, blocks
+// are released without being written, until there are no more.
+func writePipeline(blockSize byte, blocks <-chan *blockEncoder, pool *blockPool, tracer Tracer, w *bit.Writer, done chan struct{}, abort <-chan struct{}, fail func(error)) {
+	defer close(done)
+
+	aborted := func() bool {
+		select {
+		case <-abort:
+			return true
+		default:
+			return false
+		}
+	}
 
-	// Write header
+	var crc uint32
+	writeHeader := func() {
+		w.WriteBits32('B', 8)
+		w.WriteBits32('Z', 8)
+		w.WriteBits32('h', 8)
+		w.WriteBits32('0'+uint32(blockSize), 8)
+		crc = 0
+	}
+	writeTrailer := func() error {
+		w.WriteBits32(bzip2FinalMagic>>16, 32)
+		w.WriteBits32(bzip2FinalMagic&((1<<16)-1), 16)
+		w.WriteBits32(crc, 32)
+		_, err := w.Align()
+		return err
+	}
 
-	w.WriteBits32('B', 8)
-	w.WriteBits32('Z', 8)
-	w.WriteBits32('h', 8)
-	w.WriteBits32('9', 8) // FIXME: Should be '1'-'9'
+	// Write header
+	writeHeader()
+	inStream := true
 
 	// Write blocks
 	for block := range blocks {
-		fmt.Println("Waiting for block...")
+		if block.flush != nil {
+			if !aborted() && inStream {
+				if err := writeTrailer(); err != nil {
+					fail(err)
+				}
+				inStream = false
+			}
+			if !aborted() {
+				if err := w.Flush(); err != nil {
+					fail(err)
+				}
+			}
+			close(block.flush)
+			continue
+		}
+
 		block.Wait() // Wait for the block to be ready
-		fmt.Println("Block obtained")
-		block.writeTo(w)
-		fmt.Println("Wrote block")
+		if aborted() {
+			pool.release(block)
+			continue
+		}
+		if !inStream {
+			writeHeader()
+			inStream = true
+		}
+		crc = combineCRC(crc, block.crc)
+		start := w.Offset()
+		if err := block.writeTo(w); err != nil {
+			fail(err)
+		} else {
+			block.info.Bits = w.Offset() - start
+			tracer.BlockWritten(block.info)
+		}
+		pool.release(block)
 	}
 
-	// Write finalizer ?
+	// Write finalizer
+	if !aborted() && inStream {
+		if err := writeTrailer(); err != nil {
+			fail(err)
+		}
+	}
+}
 
-	done <- struct{}{}
-	fmt.Println("Signalled doneness")
+// Reset discards the Writer's state, and makes it equivalent to a new Writer
+// with the same settings, writing to dst instead. Anything that hadn't been
+// written out yet is thrown away. Buffers and scratch space are kept, so
+// reusing a Writer is cheaper than making a new one.
+//
+// Settings can be changed again after Reset, but changing the block size or
+// concurrency means new buffers have to be allocated.
+func (w *Writer) Reset(dst io.Writer) {
+	if w.headerWritten && !w.isClosed {
+		// Shut the pipeline down without writing anything more
+		w.setErr(errWriterReset)
+		close(w.sendTo)
+		<-w.closed
+	}
+	w.w.Reset(dst)
+	w.headerWritten = false
+	w.isClosed = false
+	w.err = nil
 }
 
 // SetBlockSize takes an int from 1-9, and sets the block size used by bzip2 to
@@ -170,42 +447,47 @@ func (w *Writer) SetBlockSize(n int) error {
 	return nil
 }
 
+// SetConcurrency sets the maximum number of blocks that are compressed at
+// once; one more than that are held in memory, counting the block being
+// filled. It defaults to runtime.GOMAXPROCS(0). Like SetBlockSize, it has to
+// be called before writing begins.
+func (w *Writer) SetConcurrency(n int) error {
+	if w.headerWritten {
+		return errors.New("SetConcurrency() called after writing has begun")
+	}
+	if n < 1 {
+		return errors.New("concurrency must be at least 1")
+	}
+	w.concurrency = n
+	return nil
+}
+
 // Close will finalize the writer and block until all data has been written
 // out. Once Close has been called, further calls to Write will do nothing, and
-// return an error
+// return an error. Close returns the first error from compressing or writing
+// out the data, if there was one.
 func (w *Writer) Close() error {
+	err := w.close()
+	w.tracer.Closed(err)
+	return err
+}
+
+func (w *Writer) close() error {
+	if w.isClosed {
+		return w.getErr()
+	}
+	if !w.headerWritten {
+		w.setUp()
+	}
+	w.isClosed = true
 	close(w.sendTo)
-	fmt.Println("Closing")
 	<-w.closed
-	fmt.Println("Closed")
-	w.w.Close()
-	return nil
+	if err := w.w.Close(); err != nil {
+		w.setErr(err)
+	}
+	return w.getErr()
 }
 
 func (w *Writer) writeMagicNumber() {
 
 }
-
-func rle(in []byte) (out, leftovers []byte) {
-	var count byte
-	//var lastByte byte = 0
-	for i := 1; i < len(in); i++ {
-		count++
-		if in[i] != in[i-1] || count == 255 {
-			//for j := 0; j < 4 && j < int(count); j++ {
-			//out = append(out, in[i-1])
-			//}
-			if count >= 4 {
-				out = append(out, in[i-4:i]...)
-				out = append(out, count-4)
-			} else {
-				out = append(out, in[i-int(count):i]...)
-			}
-			count = 0
-		}
-	}
-
-	leftovers = append(leftovers, in[len(in)-int(count):]...)
-
-	return out, leftovers
-}
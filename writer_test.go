@@ -1,53 +1,753 @@
 package bzip2
 
-import "testing"
+import (
+	"bytes"
+	"compress/bzip2"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	bit "github.com/fwip/bzip2w/bit"
+	huffman "github.com/fwip/bzip2w/huffman"
+)
 
 func TestRle(t *testing.T) {
-	input := []byte("AAAAAAABBBBCCCDEE")
-	expected := []byte{'A', 'A', 'A', 'A', 3, 'B', 'B', 'B', 'B', 0, 'C', 'C', 'C', 'D'}
-	expectedLeftover := []byte{'E', 'E'}
-	output, leftover := rle(input)
-	if string(output) != string(expected) {
-		t.Errorf("rle: Gave %s, expected:\n%v\nGot:\n%v\n", input, expected, output)
+	tests := []struct {
+		input, expected, leftover string
+	}{
+		{"", "", ""},
+		{"AAAAAAABBBBCCCDEE", "AAAA\x03BBBB\x00CCCD", "EE"},
+		{"ABCDDDD", "ABC", "DDDD\x00"},
+		{strings.Repeat("a", 255), "", "aaaa\xfb"},
+		{strings.Repeat("a", 256), "aaaa\xfb", "a"},
+		{strings.Repeat("a", 600) + "b", "aaaa\xfbaaaa\xfbaaaa\x56", "b"},
 	}
-	if string(output) != string(expected) {
-		t.Errorf("rle_leftover: Gave %s, expected leftover:\n%v\nGot:\n%v\n", input, expectedLeftover, leftover)
+	for _, test := range tests {
+		var enc rleEncoder
+		output, _ := enc.encode(nil, []byte(test.input), math.MaxInt32)
+		if string(output) != test.expected {
+			t.Errorf("rle: Gave %q, expected %q, got %q", test.input, test.expected, output)
+		}
+		if leftover := enc.flush(nil); string(leftover) != test.leftover {
+			t.Errorf("rle: Gave %q, expected leftover %q, got %q", test.input, test.leftover, leftover)
+		}
+	}
+}
+
+func TestRleLimit(t *testing.T) {
+	var enc rleEncoder
+	output, n := enc.encode(nil, []byte("abcdefgh"), 3)
+	if string(output) != "abc" || n != 4 {
+		t.Errorf("rle: expected to stop at %q after 4 bytes, got %q after %d", "abc", output, n)
+	}
+	// A run and its count stay together, even past the limit
+	output, n = enc.encode(nil, []byte("eeeeeeef"), 2)
+	if string(output) != "deeee\x03" || n != 8 {
+		t.Errorf("rle: expected to stop at %q after 8 bytes, got %q after %d", "deeee\x03", output, n)
+	}
+}
+
+func TestWriterBlockBoundaries(t *testing.T) {
+	// Runs of all lengths, so that some are cut short by the end of a block
+	var input []byte
+	r := rand.New(rand.NewSource(1))
+	for len(input) < 250000 {
+		input = append(input, bytes.Repeat([]byte{byte(r.Intn(4))}, 1+r.Intn(300))...)
+	}
+	var buf bytes.Buffer
+	w, _ := NewWriterLevel(&buf, 1)
+	for i := 0; i < len(input); i += 7777 {
+		end := i + 7777
+		if end > len(input) {
+			end = len(input)
+		}
+		w.Write(input[i:end])
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	output, err := ioutil.ReadAll(bzip2.NewReader(&buf))
+	if err != nil || !bytes.Equal(output, input) {
+		t.Errorf("Writer: round trip across blocks failed: %v", err)
+	}
+}
+
+func TestChunker(t *testing.T) {
+	// Writes of all sizes, some much larger than a block
+	var writes [][]byte
+	var input []byte
+	r := rand.New(rand.NewSource(1))
+	for len(writes) < 50 {
+		var write []byte
+		for n := r.Intn(5000); len(write) < n; {
+			write = append(write, bytes.Repeat([]byte{byte(r.Intn(4))}, 1+r.Intn(300))...)
+		}
+		writes = append(writes, write)
+		input = append(input, write...)
+	}
+
+	const size = 1000
+	chunks := make(chan chunk)
+	results := make(chan *blockEncoder)
+	pool := newBlockPool(size, 1)
+	go chunker(pool, defaultTableParams, nopTracer{}, chunks, results, make(chan struct{}))
+	go func() {
+		for _, write := range writes {
+			consumed := make(chan struct{})
+			chunks <- chunk{data: write, consumed: consumed}
+			<-consumed
+		}
+		close(chunks)
+	}()
+
+	var blocks []byte
+	for block := range results {
+		block.Wait()
+		if len(block.input) > size-15 {
+			t.Errorf("chunker: block of %d bytes is too long", len(block.input))
+		}
+		raw := unrle(block.input, nil)
+		if len(raw) != block.info.RawSize || updateCRC(0, raw) != block.crc {
+			t.Errorf("chunker: block's size or checksum doesn't match its input")
+		}
+		blocks = append(blocks, block.input...)
+		pool.release(block)
+	}
+
+	var enc rleEncoder
+	expected, _ := enc.encode(nil, input, math.MaxInt32)
+	expected = enc.flush(expected)
+	if !bytes.Equal(blocks, expected) {
+		t.Errorf("chunker: blocks don't add up to the RLE1 output")
+	}
+}
+
+// FuzzRle checks that rleEncoder can be undone, and that its output doesn't
+// depend on how the input is split up
+func FuzzRle(f *testing.F) {
+	f.Add([]byte("AAAAAAABBBBCCCDEE"), 3)
+	f.Add([]byte(strings.Repeat("a", 600)), 255)
+	f.Fuzz(func(t *testing.T, input []byte, split int) {
+		if split < 0 || split > len(input) {
+			split = len(input) / 2
+		}
+		var whole, parts rleEncoder
+		expected, _ := whole.encode(nil, input, math.MaxInt32)
+		expected = whole.flush(expected)
+		output, _ := parts.encode(nil, input[:split], math.MaxInt32)
+		output, _ = parts.encode(output, input[split:], math.MaxInt32)
+		output = parts.flush(output)
+		if !bytes.Equal(output, expected) {
+			t.Fatalf("rle: split at %d, expected %q, got %q", split, expected, output)
+		}
+		if undone := unrle(output, nil); !bytes.Equal(undone, input) {
+			t.Fatalf("rle: Gave %q, undid to %q", input, undone)
+		}
+	})
+}
+
+func TestWriter(t *testing.T) {
+	inputs := []string{
+		"",
+		"a",
+		"banana",
+		"AAAAAAABBBBCCCDEE",
+		"hello hello hello world, this is a test of the bzip2 writer",
+		strings.Repeat("a", 1000),
+	}
+	for _, input := range inputs {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		w.Write([]byte(input))
+		if err := w.Close(); err != nil {
+			t.Errorf("Close: %v", err)
+			continue
+		}
+		output, err := ioutil.ReadAll(bzip2.NewReader(&buf))
+		if err != nil {
+			t.Errorf("Writer: Gave %q, couldn't decompress: %v", input, err)
+			continue
+		}
+		if string(output) != input {
+			t.Errorf("Writer: Gave %q, got back %q", input, output)
+		}
+	}
+}
+
+func TestWriterFlush(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	var expected string
+	for _, input := range []string{"hello ", "", "world", "aaaaaaaaaa"} {
+		w.Write([]byte(input))
+		if err := w.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+		expected += input
+
+		// Everything so far can be read back, without closing
+		flushed := append([]byte{}, buf.Bytes()...)
+		for _, r := range []io.Reader{bzip2.NewReader(bytes.NewReader(flushed)), NewReader(bytes.NewReader(flushed))} {
+			output, err := ioutil.ReadAll(r)
+			if err != nil || string(output) != expected {
+				t.Errorf("Flush: expected %q, got %q, %v", expected, output, err)
+			}
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	output, err := ioutil.ReadAll(NewReader(&buf))
+	if err != nil || string(output) != expected {
+		t.Errorf("Close: expected %q, got %q, %v", expected, output, err)
+	}
+}
+
+func TestWriterReset(t *testing.T) {
+	inputs := []string{"hello, world", strings.Repeat("banana ", 30000), "", "aaaaaaaaaa"}
+	var buf bytes.Buffer
+	w, _ := NewWriterLevel(&buf, 1)
+	for _, input := range inputs {
+		buf.Reset()
+		w.Reset(&buf)
+		w.Write([]byte(input))
+		if err := w.Close(); err != nil {
+			t.Errorf("Close: %v", err)
+		}
+		output, err := ioutil.ReadAll(bzip2.NewReader(&buf))
+		if err != nil || string(output) != input {
+			t.Errorf("Reset: Gave %q, got back %q, %v", input, output, err)
+		}
+	}
+
+	// Resetting partway through throws away what was written
+	var discarded bytes.Buffer
+	w.Reset(&discarded)
+	w.Write([]byte(inputs[1]))
+	buf.Reset()
+	w.Reset(&buf)
+	if err := w.SetBlockSize(2); err != nil {
+		t.Errorf("SetBlockSize: expected to work after Reset, got %v", err)
+	}
+	w.Write([]byte(inputs[0]))
+	if err := w.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	output, err := ioutil.ReadAll(bzip2.NewReader(&buf))
+	if err != nil || string(output) != inputs[0] {
+		t.Errorf("Reset: Gave %q, got back %q, %v", inputs[0], output, err)
 	}
+}
 
+func BenchmarkWriterReset(b *testing.B) {
+	input := bytes.Repeat([]byte("hello, world. "), 1000)
+	w, _ := NewWriterLevel(ioutil.Discard, 1)
+	b.SetBytes(int64(len(input)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		w.Reset(ioutil.Discard)
+		w.Write(input)
+		w.Close()
+	}
+}
+
+func TestWriterErrorShutsDown(t *testing.T) {
+	failure := errors.New("disk full")
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		w, _ := NewWriterLevel(&failingWriter{err: failure}, 1)
+		w.Write([]byte("hello"))
+		if err := w.Flush(); err != failure {
+			t.Errorf("Flush: expected %v, got %v", failure, err)
+		}
+		// The Writer is dropped without being closed
+	}
+
+	// Give the pipeline's goroutines a moment to notice
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("Expected goroutines to shut down after an error, went from %d to %d", before, after)
+	}
+}
+
+// failingWriter accepts n bytes, then fails
+type failingWriter struct {
+	n   int
+	err error
+}
+
+func (f *failingWriter) Write(b []byte) (int, error) {
+	if len(b) > f.n {
+		n := f.n
+		f.n = 0
+		return n, f.err
+	}
+	f.n -= len(b)
+	return len(b), nil
+}
+
+func TestWriterError(t *testing.T) {
+	failure := errors.New("disk full")
+	chunk := make([]byte, 10000)
+	for _, limit := range []int{0, 100, 5000} {
+		w := NewWriter(&failingWriter{n: limit, err: failure})
+		for i := 0; i < 20; i++ {
+			rand.Read(chunk)
+			if _, err := w.Write(chunk); err != nil {
+				if err != failure {
+					t.Errorf("Write: expected %v, got %v", failure, err)
+				}
+				break
+			}
+		}
+		if err := w.Close(); err != failure {
+			t.Errorf("Close: expected %v, got %v", failure, err)
+		}
+		if _, err := w.Write(chunk); err == nil {
+			t.Errorf("Write: expected an error after Close")
+		}
+	}
+
+	// Writes after a successful Close fail too
+	w := NewWriter(ioutil.Discard)
+	if err := w.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	if _, err := w.Write([]byte("banana")); err != errWriterClosed {
+		t.Errorf("Write: expected %v, got %v", errWriterClosed, err)
+	}
+}
+
+func TestSetBlockSize(t *testing.T) {
+	for level := 1; level <= 9; level++ {
+		var buf bytes.Buffer
+		w, err := NewWriterLevel(&buf, level)
+		if err != nil {
+			t.Fatalf("NewWriterLevel(%d): %v", level, err)
+		}
+		w.Write([]byte("banana"))
+		if err := w.SetBlockSize(1); err == nil {
+			t.Errorf("SetBlockSize: expected an error after Write")
+		}
+		w.Close()
+		if header := buf.String()[:4]; header != "BZh"+string('0'+byte(level)) {
+			t.Errorf("NewWriterLevel(%d): got header %q", level, header)
+		}
+	}
+	for _, level := range []int{0, 10} {
+		if _, err := NewWriterLevel(nil, level); err == nil {
+			t.Errorf("NewWriterLevel(%d): expected an error", level)
+		}
+	}
+}
+
+func TestSetConcurrency(t *testing.T) {
+	input := strings.Repeat("hello, world. ", 20000)
+	for _, n := range []int{1, 2, 8} {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		if err := w.SetConcurrency(n); err != nil {
+			t.Fatalf("SetConcurrency(%d): %v", n, err)
+		}
+		// Flushing cuts the input into several blocks
+		for i := 0; i < len(input); i += 40000 {
+			w.Write([]byte(input[i : i+40000]))
+			w.Flush()
+		}
+		if err := w.SetConcurrency(1); err == nil {
+			t.Errorf("SetConcurrency: expected an error after Write")
+		}
+		if err := w.Close(); err != nil {
+			t.Errorf("Close: %v", err)
+		}
+		output, err := ioutil.ReadAll(bzip2.NewReader(&buf))
+		if err != nil || string(output) != input {
+			t.Errorf("SetConcurrency(%d): round trip failed: %v", n, err)
+		}
+	}
+	if err := NewWriter(nil).SetConcurrency(0); err == nil {
+		t.Errorf("SetConcurrency(0): expected an error")
+	}
+}
+
+// stallingWriter blocks every write until release is closed
+type stallingWriter struct {
+	buf     bytes.Buffer
+	release chan struct{}
+}
+
+func (s *stallingWriter) Write(b []byte) (int, error) {
+	<-s.release
+	return s.buf.Write(b)
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	// Random bytes hardly shrink under RLE1, so each block holds about 100k
+	r := rand.New(rand.NewSource(1))
+	input := make([]byte, 10*100000)
+	r.Read(input)
+
+	for _, n := range []int{1, 2, 4} {
+		dst := &stallingWriter{release: make(chan struct{})}
+		tracer := &recordingTracer{}
+		w, err := NewWriterOptions(dst, BlockSize(1), Concurrency(n), Trace(tracer))
+		if err != nil {
+			t.Fatalf("NewWriterOptions: %v", err)
+		}
+
+		var accepted int64
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < len(input); i += 10000 {
+				w.Write(input[i : i+10000])
+				atomic.AddInt64(&accepted, 10000)
+			}
+		}()
+
+		// With nothing being written out, blocks pile up until n are in flight
+		deadline := time.Now().Add(5 * time.Second)
+		for started, _ := tracer.counts(); started < n && time.Now().Before(deadline); started, _ = tracer.counts() {
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if started, wrote := tracer.counts(); started != n || wrote != 0 {
+			t.Errorf("Concurrency(%d): stalled with %d blocks started and %d written", n, started, wrote)
+		}
+		// Write waits too, rather than taking in more than the blocks in
+		// flight and the one being filled
+		select {
+		case <-done:
+			t.Errorf("Concurrency(%d): Write didn't block while the output was stalled", n)
+		default:
+		}
+		if got := atomic.LoadInt64(&accepted); got > int64(n+1)*100000 {
+			t.Errorf("Concurrency(%d): Write took %d bytes while the output was stalled", n, got)
+		}
+
+		close(dst.release)
+		<-done
+		if err := w.Close(); err != nil {
+			t.Errorf("Close: %v", err)
+		}
+		if tracer.maxInFlight > n {
+			t.Errorf("Concurrency(%d): %d blocks were in flight at once", n, tracer.maxInFlight)
+		}
+		output, err := ioutil.ReadAll(bzip2.NewReader(&dst.buf))
+		if err != nil || !bytes.Equal(output, input) {
+			t.Errorf("Concurrency(%d): round trip failed: %v", n, err)
+		}
+	}
+}
+
+func TestNewWriterOptions(t *testing.T) {
+	input := "hello hello hello world, this is a test of the bzip2 writer"
+	valid := [][]Option{
+		nil,
+		{BlockSize(1), Concurrency(1)},
+		{HuffmanTables(2), HuffmanIterations(1)},
+		{HuffmanTables(6), HuffmanIterations(10)},
+		{HuffmanTables(0)},
+	}
+	for _, opts := range valid {
+		var buf bytes.Buffer
+		w, err := NewWriterOptions(&buf, opts...)
+		if err != nil {
+			t.Errorf("NewWriterOptions: %v", err)
+			continue
+		}
+		w.Write([]byte(input))
+		if err := w.Close(); err != nil {
+			t.Errorf("Close: %v", err)
+		}
+		output, err := ioutil.ReadAll(bzip2.NewReader(&buf))
+		if err != nil || string(output) != input {
+			t.Errorf("NewWriterOptions: got back %q, %v", output, err)
+		}
+	}
+
+	invalid := []Option{
+		BlockSize(0), BlockSize(10),
+		Concurrency(0),
+		HuffmanTables(1), HuffmanTables(7),
+		HuffmanIterations(0),
+	}
+	for i, opt := range invalid {
+		if _, err := NewWriterOptions(nil, BlockSize(1), opt); err == nil {
+			t.Errorf("NewWriterOptions: expected an error for invalid option %d", i)
+		}
+	}
+}
+
+// recordingTracer keeps track of everything it's told
+type recordingTracer struct {
+	mu                      sync.Mutex
+	started, encoded, wrote []BlockInfo
+	flushes, closes         int
+	flushErr, closeErr      error
+	maxInFlight             int // Most blocks started but not yet written
+}
+
+func (r *recordingTracer) BlockStarted(b BlockInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.started = append(r.started, b)
+	if n := len(r.started) - len(r.wrote); n > r.maxInFlight {
+		r.maxInFlight = n
+	}
+}
+
+// counts returns how many blocks have been started and written so far
+func (r *recordingTracer) counts() (started, wrote int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.started), len(r.wrote)
+}
+
+func (r *recordingTracer) BlockEncoded(b BlockInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.encoded = append(r.encoded, b)
+}
+
+func (r *recordingTracer) BlockWritten(b BlockInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.wrote = append(r.wrote, b)
+}
+
+func (r *recordingTracer) Flushed(err error) {
+	r.flushes++
+	r.flushErr = err
+}
+
+func (r *recordingTracer) Closed(err error) {
+	r.closes++
+	r.closeErr = err
+}
+
+func TestTrace(t *testing.T) {
+	input := []byte(strings.Repeat("hello, world. ", 20000))
+	var buf bytes.Buffer
+	tracer := &recordingTracer{}
+	w, err := NewWriterOptions(&buf, BlockSize(1), Trace(tracer))
+	if err != nil {
+		t.Fatalf("NewWriterOptions: %v", err)
+	}
+	w.Write(input[:1000])
+	w.Flush()
+	w.Write(input[1000:])
+	w.Close()
+
+	// 1000 bytes, then the remaining 279000 in 100k blocks
+	if len(tracer.started) != 4 || len(tracer.encoded) != 4 || len(tracer.wrote) != 4 {
+		t.Fatalf("Trace: expected 4 blocks, got %d started, %d encoded and %d written",
+			len(tracer.started), len(tracer.encoded), len(tracer.wrote))
+	}
+	if tracer.flushes != 1 || tracer.closes != 1 {
+		t.Errorf("Trace: expected 1 flush and 1 close, got %d and %d", tracer.flushes, tracer.closes)
+	}
+
+	// Calls that fail straight away are traced too
+	flushErr, closeErr := w.Flush(), w.Close()
+	if tracer.flushes != 2 || tracer.flushErr != flushErr || flushErr != errWriterClosed {
+		t.Errorf("Trace: Flush after Close returned %v, traced %d flushes with %v", flushErr, tracer.flushes, tracer.flushErr)
+	}
+	if tracer.closes != 2 || tracer.closeErr != closeErr {
+		t.Errorf("Trace: second Close returned %v, traced %d closes with %v", closeErr, tracer.closes, tracer.closeErr)
+	}
+	var raw int
+	var bits int64
+	for i, b := range tracer.wrote {
+		if b.Index != i || b.RLESize > 1e5 || b.EncodeTime <= 0 || b.Bits <= 0 {
+			t.Errorf("Trace: unexpected block %d: %+v", i, b)
+		}
+		raw += b.RawSize
+		bits += b.Bits
+	}
+	if raw != len(input) {
+		t.Errorf("Trace: blocks held %d bytes, expected %d", raw, len(input))
+	}
+	if bits > int64(buf.Len())*8 {
+		t.Errorf("Trace: blocks took up %d bits, more than the output's %d bytes", bits, buf.Len())
+	}
+}
+
+// bwtNaive sorts every rotation of the input, for comparison with bwt
+func bwtNaive(in []byte) (out []byte, matrix []string) {
+	matrix = make([]string, len(in))
+	for i := range in {
+		matrix[i] = string(in[len(in)-i:]) + string(in[:len(in)-i])
+	}
+	sort.Strings(matrix)
+	for i := range in {
+		out = append(out, matrix[i][len(in)-1])
+	}
+	return out, matrix
+}
+
+var bwtTests = []string{
+	"^BANANA|",
+	"a",
+	"abracadabra",
+	"mississippi",
+	strings.Repeat("a", 100),
+	strings.Repeat("ab", 50),
+	strings.Repeat("abcabd", 40),
+	strings.Repeat("x", 37) + "y" + strings.Repeat("x", 50),
 }
 
 func TestBwt(t *testing.T) {
 	input := []byte("^BANANA|")
 	expected := []byte("BNN^AA|A")
-	output := bwt(input)
+	output, _ := bwt(input, nil, nil)
 	if string(output) != string(expected) {
 		t.Errorf("\nbwt: Gave %s, expected:\n%v\nGot:\n%v (%s)\n", input, expected, output, output)
 	}
+
+	random := make([]byte, 1000)
+	for i := range random {
+		random[i] = byte(rand.Intn(4))
+	}
+	// Scratch space is reused between inputs of different sizes
+	var scratch saScratch
+	for _, input := range append(bwtTests, string(random)) {
+		expected, matrix := bwtNaive([]byte(input))
+		output, origPtr := bwt([]byte(input), nil, nil)
+		if string(output) != string(expected) {
+			t.Errorf("\nbwt: Gave %q, expected:\n%q\nGot:\n%q\n", input, expected, output)
+		}
+		if reused, _ := bwt([]byte(input), nil, &scratch); string(reused) != string(expected) {
+			t.Errorf("\nbwt: Gave %q with reused scratch space, expected:\n%q\nGot:\n%q\n", input, expected, reused)
+		}
+		if matrix[origPtr] != input {
+			t.Errorf("bwt: Gave %q, origPtr %d points at %q", input, origPtr, matrix[origPtr])
+		}
+	}
+}
+
+func TestBwtOrigPtr(t *testing.T) {
+	for _, input := range bwtTests {
+		output, origPtr := bwt([]byte(input), nil, nil)
+		if origPtr < 0 || origPtr >= len(input) {
+			t.Errorf("bwt: Gave %q, origPtr %d is out of range", input, origPtr)
+			continue
+		}
+		if inverse := unbwt(output, origPtr, make([]uint32, len(output))); string(inverse) != input {
+			t.Errorf("bwt: Gave %q, inverted to %q using origPtr %d", input, inverse, origPtr)
+		}
+	}
+}
+
+func benchmarkBwt(b *testing.B, input []byte) {
+	b.SetBytes(int64(len(input)))
+	b.ReportAllocs()
+	var out []byte
+	var scratch saScratch
+	for i := 0; i < b.N; i++ {
+		out, _ = bwt(input, out[:0], &scratch)
+	}
+}
+
+func BenchmarkBwt(b *testing.B) {
+	const size = 9e5
+	random := make([]byte, size)
+	rand.Read(random)
+	b.Run("Banana", func(b *testing.B) { benchmarkBwt(b, []byte(bwtTests[0])) })
+	b.Run("Random", func(b *testing.B) { benchmarkBwt(b, random) })
+	b.Run("Identical", func(b *testing.B) { benchmarkBwt(b, bytes.Repeat([]byte{'a'}, size)) })
+	b.Run("Periodic", func(b *testing.B) { benchmarkBwt(b, bytes.Repeat([]byte("abcdefgh"), size/8)) })
 }
 
 func TestMtf(t *testing.T) {
 
 	input := []byte("bananaaa")
 	expected := []byte{1, 1, 2, 1, 1, 1, 0, 0}
-	_, output := mtf(input)
+	_, output := mtf(input, nil)
 	if string(output) != string(expected) {
 		t.Errorf("\nmtf: Gave %v, expected:\n%v\nGot:\n%v\n", input, expected, output)
 	}
 }
 
+func TestWriteUsed(t *testing.T) {
+	var used [256]bool
+	for _, c := range []byte("abz") {
+		used[c] = true
+	}
+
+	var buf bytes.Buffer
+	w := bit.NewWriter(&buf)
+	writeUsed(w, &used)
+	w.Close()
+
+	// Only the ranges 0x60-0x6f and 0x70-0x7f get bitmaps
+	expected := []byte{0x03, 0x00, 0x60, 0x00, 0x00, 0x20}
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Errorf("writeUsed: expected %x, got %x", expected, buf.Bytes())
+	}
+
+	// MTF output only indexes the used bytes
+	input := []byte("zabzzbaab")
+	used, output := mtf(input, nil)
+	if n := countUsed(&used); n != 3 {
+		t.Errorf("countUsed: expected 3, got %d", n)
+	}
+	for _, c := range output {
+		if c >= 3 {
+			t.Errorf("mtf: Gave %s, got index %d outside of the 3 used bytes", input, c)
+		}
+	}
+}
+
 func TestRleMTF(t *testing.T) {
 	input := []byte{0, 0, 0, 0, 0, 1, 0}
-	expected := []uint16{runA, runB, 2, runA}
-	output := rleMTF(input)
+	expected := []uint16{runA, runB, 2, runA, 3}
+	expectedFreq := []int{2, 1, 1, 1}
+	output, freq := rleMTF(input, 2, nil)
 	if len(output) != len(expected) {
-		t.Errorf("\nrle_mtf: Gave %v, expected:\n%v\nGot:\n%v\n", input, expected, output)
+		t.Fatalf("\nrle_mtf: Gave %v, expected:\n%v\nGot:\n%v\n", input, expected, output)
 	}
 	for i := range expected {
 		if output[i] != expected[i] {
 			t.Errorf("\nrle_mtf: Gave %v, expected:\n%v\nGot:\n%v\n", input, expected, output)
 		}
 	}
+	for i := range expectedFreq {
+		if freq[i] != expectedFreq[i] {
+			t.Errorf("\nrle_mtf: Gave %v, expected frequencies:\n%v\nGot:\n%v\n", input, expectedFreq, freq)
+		}
+	}
 
+	// Runs too long for a uint16
+	input = make([]byte, 70000)
+	output, _ = rleMTF(input, 1, nil)
+	var count, place int
+	for _, s := range output[:len(output)-1] {
+		if s == runA {
+			count += 1 << uint(place)
+		} else {
+			count += 2 << uint(place)
+		}
+		place++
+	}
+	if count != len(input) {
+		t.Errorf("rle_mtf: Gave %d zeroes, got back %d", len(input), count)
+	}
+	if eob := output[len(output)-1]; eob != 2 {
+		t.Errorf("rle_mtf: expected EOB 2, got %d", eob)
+	}
 }
 
 /*
@@ -57,3 +757,115 @@ func TestMagicNumber(t *testing.T) {
 	}
 }
 */
+
+func TestCRC(t *testing.T) {
+	input := []byte("123456789")
+	var expected uint32 = 0xfc891918
+	if output := updateCRC(0, input); output != expected {
+		t.Errorf("updateCRC: Gave %s, expected %08x, got %08x", input, expected, output)
+	}
+
+	input = []byte("AAAAAAAAAAAABBBBCCCDDDDD")
+	encoded := []byte{'A', 'A', 'A', 'A', 8, 'B', 'B', 'B', 'B', 0, 'C', 'C', 'C', 'D', 'D', 'D', 'D', 1}
+	if output, expected := blockCRC(encoded), updateCRC(0, input); output != expected {
+		t.Errorf("blockCRC: Gave %v, expected %08x, got %08x", encoded, expected, output)
+	}
+
+	// rleEncoder counts the input that goes into each block
+	var enc rleEncoder
+	output, _ := enc.encode(nil, input, math.MaxInt32)
+	if output = enc.flush(output); !bytes.Equal(output, encoded) {
+		t.Errorf("rleEncoder: Gave %s, expected %v, got %v", input, encoded, output)
+	}
+	if raw := enc.cut(); raw != len(input) {
+		t.Errorf("rleEncoder: Gave %s, expected %d bytes, got %d", input, len(input), raw)
+	}
+}
+
+func TestChooseTrees(t *testing.T) {
+	// Two halves with disjoint alphabets should get different tables
+	var symbols []uint16
+	for i := 0; i < 5000; i++ {
+		symbols = append(symbols, uint16(rand.Intn(4)))
+	}
+	for i := 0; i < 5000; i++ {
+		symbols = append(symbols, uint16(4+rand.Intn(4)))
+	}
+	freq := make([]int, 8)
+	for _, s := range symbols {
+		freq[s]++
+	}
+
+	trees, selectors := chooseTrees(symbols, freq, defaultTableParams, nil)
+	if len(trees) != numTrees(len(symbols)) {
+		t.Errorf("chooseTrees: expected %d trees, got %d", numTrees(len(symbols)), len(trees))
+	}
+	if len(selectors) != len(symbols)/groupSize {
+		t.Fatalf("chooseTrees: expected %d selectors, got %d", len(symbols)/groupSize, len(selectors))
+	}
+
+	single := huffman.NewBook(freq)
+	var cost, singleCost uint
+	for i, s := range symbols {
+		cost += trees[selectors[i/groupSize]].Codes[s].Len()
+		singleCost += single.Codes[s].Len()
+	}
+	if cost >= singleCost {
+		t.Errorf("chooseTrees: %d bits with multiple tables, %d bits with one", cost, singleCost)
+	}
+}
+
+// readBits reads n bits, MSB-first, starting at bit offset *pos of b
+func readBits(b []byte, pos *int, n int) (v uint32) {
+	for ; n > 0; n-- {
+		v = v<<1 | uint32(b[*pos>>3]>>(7-uint(*pos&7))&1)
+		*pos++
+	}
+	return v
+}
+
+// readSelectors inverts writeSelectors
+func readSelectors(b []byte, nTrees int) []byte {
+	var pos int
+	mtfd := make([]byte, readBits(b, &pos, 15))
+	for i := range mtfd {
+		for readBits(b, &pos, 1) == 1 {
+			mtfd[i]++
+		}
+	}
+	return unMoveToFront(mtfd, selectorOrder(nTrees))
+}
+
+func TestSelectors(t *testing.T) {
+	tests := []struct {
+		selectors []byte
+		nTrees    int
+	}{
+		{[]byte{}, 2},
+		{[]byte{0, 0, 0}, 2},
+		{[]byte{1, 1, 0, 1}, 2},
+		{[]byte{5, 2, 2, 3, 0, 5, 5, 1, 4}, 6},
+		{[]byte{2, 2, 0}, 3},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		w := bit.NewWriter(&buf)
+		writeSelectors(w, test.selectors, test.nTrees)
+		w.Align()
+		w.Close()
+
+		output := readSelectors(buf.Bytes(), test.nTrees)
+		if string(output) != string(test.selectors) {
+			t.Errorf("writeSelectors: Gave %v, read back %v", test.selectors, output)
+		}
+	}
+
+	// All selectors the same is one bit each, after the first
+	var buf bytes.Buffer
+	w := bit.NewWriter(&buf)
+	writeSelectors(w, []byte{1, 1, 1, 1, 1, 1, 1, 1}, 2)
+	w.Close()
+	if expected := []byte{0, 0x11, 0}; !bytes.Equal(buf.Bytes(), expected) {
+		t.Errorf("writeSelectors: expected %08b, got %08b", expected, buf.Bytes())
+	}
+}